@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"ttnmapper-tms/types"
+)
+
+// GetCellsGeoJson streams the z19 grid cells inside a bounding box as a GeoJSON FeatureCollection.
+// Query parameters: network_id, optional gateway_id or further networks, bbox=minLon,minLat,maxLon,maxLat,
+// optional since and until and optional include_offline
+func (s *TileServer) GetCellsGeoJson(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	networkId := query.Get("network_id")
+	if networkId == "" {
+		http.Error(w, "network_id required", http.StatusBadRequest)
+		return
+	}
+	gatewayId := query.Get("gateway_id")
+
+	boundingBox, err := ParseBoundingBox(query.Get("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	xMin, yMin, xMax, yMax := boundingBox.Z19Range()
+
+	// Reject large areas before querying them
+	if area := (xMax - xMin + 1) * (yMax - yMin + 1); area > myConfiguration.GeoJsonMaxCells {
+		http.Error(w, fmt.Sprintf("bbox covers %d cells, the maximum is %d", area, myConfiguration.GeoJsonMaxCells), http.StatusBadRequest)
+		return
+	}
+
+	window, err := GetRequestTimeWindow(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	networks, err := GetRequestNetworks(r, TileRequest{NetworkId: networkId, SingleGateway: gatewayId != ""})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	includeOffline, err := GetRequestIncludeOffline(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Cells GeoJSON %s - %s: %d,%d %d,%d\t", networkId, gatewayId, xMin, yMin, xMax, yMax)
+
+	var cells []types.MergedGridCell
+	if gatewayId != "" {
+		cells, err = GetGatewayMergedCellsInRange(s.store, networkId, gatewayId, xMin, yMin, xMax, yMax, window)
+	} else {
+		cells, err = GetNetworkMergedCellsInRange(s.store, append([]string{networkId}, networks...), xMin, yMin, xMax, yMax, window, AntennaSelection{IncludeOffline: includeOffline})
+	}
+
+	// Database error
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/geo+json")
+
+	// Write the features one by one, so that large collections are not built in memory
+	_, err = fmt.Fprint(w, `{"type":"FeatureCollection","features":[`)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	flusher, canFlush := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	for i, cell := range cells {
+		if i > 0 {
+			_, err = fmt.Fprint(w, ",")
+			if err != nil {
+				log.Println(err.Error())
+				return
+			}
+		}
+
+		err = encoder.Encode(CreateCellFeature(cell))
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+
+		if canFlush && i%1000 == 999 {
+			flusher.Flush()
+		}
+	}
+
+	_, err = fmt.Fprint(w, "]}")
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Create a square polygon feature for a z19 grid cell, with its bucket counts as properties
+func CreateCellFeature(cell types.MergedGridCell) types.GeoJsonFeature {
+	west := TileXToLon(float64(cell.X), 19)
+	east := TileXToLon(float64(cell.X+1), 19)
+	north := TileYToLat(float64(cell.Y), 19)
+	south := TileYToLat(float64(cell.Y+1), 19)
+
+	properties := map[string]interface{}{
+		"x":             cell.X,
+		"y":             cell.Y,
+		"max_bucket":    getMaxBucket(cell.GridCell),
+		"antenna_count": cell.AntennaCount,
+	}
+	for i, count := range gridCellBuckets(cell.GridCell) {
+		properties[bucketNames[i]] = count
+	}
+
+	return types.GeoJsonFeature{
+		Type: "Feature",
+		Geometry: types.GeoJsonGeometry{
+			Type: "Polygon",
+			// Exterior ring counterclockwise
+			Coordinates: [][][2]float64{{{west, north}, {west, south}, {east, south}, {east, north}, {west, north}}},
+		},
+		Properties: properties,
+	}
+}
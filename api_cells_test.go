@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"ttnmapper-tms/types"
+)
+
+// The bbox of the test tile, slightly inset so that neighbouring cells are not included
+func testTileBbox() string {
+	return fmt.Sprintf("%f,%f,%f,%f",
+		TileXToLon(testTileX+0.001, testTileZ), TileYToLat(testTileY+0.999, testTileZ),
+		TileXToLon(testTileX+0.999, testTileZ), TileYToLat(testTileY+0.001, testTileZ))
+}
+
+func TestGetCellsGeoJson(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	collection := getTestResponse(t, server, "/api/cells.geojson?network_id="+url.QueryEscape(testNetworkId)+"&bbox="+testTileBbox(), decodeTestJson[types.GeoJsonFeatureCollection])
+	if len(collection.Features) != 2 {
+		t.Fatalf("expected 2 features, got %d", len(collection.Features))
+	}
+
+	properties := collection.Features[0].Properties
+	if properties["x"] != 289610.0 || properties["bucket_high"] != 5.0 || properties["bucket_110"] != 3.0 || properties["antenna_count"] != 2.0 {
+		t.Errorf("unexpected properties %v", properties)
+	}
+}
+
+func TestGetCellsGeoJsonLimits(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	maxCells := myConfiguration.GeoJsonMaxCells
+	myConfiguration.GeoJsonMaxCells = 1
+	defer func() { myConfiguration.GeoJsonMaxCells = maxCells }()
+
+	for _, query := range []string{
+		"network_id=" + url.QueryEscape(testNetworkId) + "&bbox=" + testTileBbox(),
+		"network_id=" + url.QueryEscape(testNetworkId) + "&bbox=1,2,3",
+		"bbox=" + testTileBbox(),
+	} {
+		resp, err := http.Get(server.URL + "/api/cells.geojson?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", query, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"ttnmapper-tms/types"
+)
+
+// Maximum number of locations in one batch coverage request, and the size of the body they are posted in
+const (
+	coverageMaxLocations = 1000
+	coverageMaxBodySize  = 1 << 20
+)
+
+// The locations of a batch that fall in the same tile at this zoom are looked up with one query
+const coverageGroupZoom = 13
+
+// Web mercator does not reach the poles
+const mercatorMaxLat = 85.05112878
+
+type antennaCoverageResponse struct {
+	GatewayId    string          `json:"gateway_id"`
+	AntennaIndex uint8           `json:"antenna_index"`
+	Buckets      map[string]uint `json:"buckets"`
+	ModalBucket  string          `json:"modal_bucket"`
+	Measurements uint            `json:"measurements"`
+	LastUpdated  string          `json:"last_updated"`
+}
+
+type coverageLocation struct {
+	Id  string  `json:"id"`
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+type locationCoverageResponse struct {
+	coverageLocation
+	Covered      bool    `json:"covered"`
+	GatewayId    *string `json:"gateway_id"`
+	AntennaIndex *uint8  `json:"antenna_index"`
+	Bucket       *string `json:"bucket"`
+	Measurements uint    `json:"measurements"`
+}
+
+// antennaCoverage is the grid cell of one antenna at a location
+type antennaCoverage struct {
+	Antenna  types.Antenna
+	GridCell types.GridCell
+}
+
+// GetCoverage returns the coverage of every antenna of a network at one location, so that it is known in advance
+// whether a device placed there will be heard.
+// Query parameters: network_id, lat, lon, optional since and until, include_offline and since_install
+func (s *TileServer) GetCoverage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	networkId, window, selection, err := GetRequestCoverageOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	location := coverageLocation{}
+	location.Lat, err = strconv.ParseFloat(query.Get("lat"), 64)
+	if err != nil {
+		http.Error(w, "lat invalid", http.StatusBadRequest)
+		return
+	}
+	location.Lon, err = strconv.ParseFloat(query.Get("lon"), 64)
+	if err != nil {
+		http.Error(w, "lon invalid", http.StatusBadRequest)
+		return
+	}
+	err = validateCoverageLocation(location)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	x, y := locationZ19Cell(location)
+	log.Printf("Coverage %s: %d,%d\t", networkId, x, y)
+
+	coverages, err := GetAntennaCoverageInRange(s.store, networkId, x, y, x, y, window, selection)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		NetworkId string                    `json:"network_id"`
+		Lat       float64                   `json:"lat"`
+		Lon       float64                   `json:"lon"`
+		X         int                       `json:"x"`
+		Y         int                       `json:"y"`
+		Antennas  []antennaCoverageResponse `json:"antennas"`
+	}{NetworkId: networkId, Lat: location.Lat, Lon: location.Lon, X: x, Y: y, Antennas: []antennaCoverageResponse{}}
+
+	for _, coverage := range coverages[types.GridCellIndexer{X: x, Y: y}] {
+		buckets := map[string]uint{}
+		for i, count := range gridCellBuckets(coverage.GridCell) {
+			buckets[bucketNames[i]] = count
+		}
+		response.Antennas = append(response.Antennas, antennaCoverageResponse{
+			GatewayId:    coverage.Antenna.GatewayId,
+			AntennaIndex: coverage.Antenna.AntennaIndex,
+			Buckets:      buckets,
+			ModalBucket:  bucketNames[getMaxBucket(coverage.GridCell)],
+			Measurements: gridCellMeasurementCount(coverage.GridCell),
+			LastUpdated:  coverage.GridCell.LastUpdated.UTC().Format(time.RFC3339),
+		})
+	}
+
+	writeJson(w, response)
+}
+
+// PostCoverage returns the best antenna and the signal expected from it for a list of locations. The locations are
+// posted as a JSON array of objects with an id, lat and lon, or as CSV with a header row naming the id, lat and lon
+// columns. CSV requests are answered with CSV, others with JSON.
+// Query parameters: like GetCoverage, without lat and lon
+func (s *TileServer) PostCoverage(w http.ResponseWriter, r *http.Request) {
+	networkId, window, selection, err := GetRequestCoverageOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isCsv := mediaType == "text/csv"
+
+	// Parsing stops after one location too many
+	body := http.MaxBytesReader(w, r.Body, coverageMaxBodySize)
+	var locations []coverageLocation
+	if isCsv {
+		locations, err = parseCoverageCsv(body)
+	} else {
+		locations, err = parseCoverageJson(body)
+	}
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		http.Error(w, fmt.Sprintf("body too large, the maximum is %d bytes", coverageMaxBodySize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "locations invalid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(locations) > coverageMaxLocations {
+		http.Error(w, fmt.Sprintf("more than %d locations posted", coverageMaxLocations), http.StatusBadRequest)
+		return
+	}
+	for i, location := range locations {
+		err = validateCoverageLocation(location)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("location %d: %s", i+1, err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	log.Printf("Coverage %s: %d locations\t", networkId, len(locations))
+
+	responses, err := GetLocationsCoverage(r.Context(), s.store, networkId, locations, window, selection)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	if isCsv {
+		writeCoverageCsv(w, responses)
+		return
+	}
+	writeJson(w, responses)
+}
+
+// Return the network, time window and antenna selection of a coverage request
+func GetRequestCoverageOptions(r *http.Request) (string, TimeWindow, AntennaSelection, error) {
+	var window TimeWindow
+	var selection AntennaSelection
+
+	networkId := r.URL.Query().Get("network_id")
+	if networkId == "" {
+		return networkId, window, selection, errors.New("network_id required")
+	}
+
+	var err error
+	window, err = GetRequestTimeWindow(r)
+	if err != nil {
+		return networkId, window, selection, err
+	}
+	selection.IncludeOffline, err = GetRequestIncludeOffline(r)
+	if err != nil {
+		return networkId, window, selection, err
+	}
+	selection.SinceInstall, err = GetRequestSinceInstall(r, false)
+	if err != nil {
+		return networkId, window, selection, err
+	}
+
+	return networkId, window, selection, nil
+}
+
+// Return the best antenna of a network at each location. Locations close together are looked up with one query.
+// The lookup stops when the context is cancelled.
+func GetLocationsCoverage(ctx context.Context, store SampleStore, networkId string, locations []coverageLocation, window TimeWindow, selection AntennaSelection) ([]locationCoverageResponse, error) {
+	// Group the locations by tile, in the order they were posted
+	shift := 19 - coverageGroupZoom
+	var tiles []types.GridCellIndexer
+	groups := map[types.GridCellIndexer][]int{}
+	for i, location := range locations {
+		x, y := locationZ19Cell(location)
+		tile := types.GridCellIndexer{X: x >> shift, Y: y >> shift}
+		if _, ok := groups[tile]; !ok {
+			tiles = append(tiles, tile)
+		}
+		groups[tile] = append(groups[tile], i)
+	}
+
+	responses := make([]locationCoverageResponse, len(locations))
+	for _, tile := range tiles {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// Only query the cells of the group, not the whole tile
+		xMin, yMin, xMax, yMax := math.MaxInt, math.MaxInt, math.MinInt, math.MinInt
+		for _, i := range groups[tile] {
+			x, y := locationZ19Cell(locations[i])
+			xMin, yMin, xMax, yMax = min(xMin, x), min(yMin, y), max(xMax, x), max(yMax, y)
+		}
+		coverages, err := GetAntennaCoverageInRange(store, networkId, xMin, yMin, xMax, yMax, window, selection)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, i := range groups[tile] {
+			x, y := locationZ19Cell(locations[i])
+			responses[i] = newLocationCoverageResponse(locations[i], coverages[types.GridCellIndexer{X: x, Y: y}])
+		}
+	}
+
+	return responses, nil
+}
+
+// The best of the antennas covering a location, if any of them heard it
+func newLocationCoverageResponse(location coverageLocation, coverages []antennaCoverage) locationCoverageResponse {
+	response := locationCoverageResponse{coverageLocation: location}
+	if len(coverages) == 0 {
+		return response
+	}
+
+	// The antennas are ordered best first
+	best := coverages[0]
+	bucketIndex := getMaxBucket(best.GridCell)
+	if bucketIndex < len(bucketNames)-1 {
+		response.Covered = true
+		response.GatewayId = &best.Antenna.GatewayId
+		response.AntennaIndex = &best.Antenna.AntennaIndex
+		bucket := bucketNames[bucketIndex]
+		response.Bucket = &bucket
+		response.Measurements = gridCellMeasurementCount(best.GridCell)
+	}
+	return response
+}
+
+// Return the grid cells of the antennas of a network between a range of z19 x and y indexes, with the antennas they
+// belong to, per cell. Only the antennas shown on the network tiles are returned, ordered by their modal bucket,
+// strongest first, and then by the number of measurements.
+func GetAntennaCoverageInRange(store SampleStore, networkId string, xMin int, yMin int, xMax int, yMax int, window TimeWindow, selection AntennaSelection) (map[types.GridCellIndexer][]antennaCoverage, error) {
+	gridCells, err := store.GetNetworkGridCellsInRange(networkId, xMin, yMin, xMax, yMax, window)
+	if err != nil {
+		return nil, err
+	}
+	gridCells, err = visibleGridCells(store, gridCells, selection)
+	if err != nil {
+		return nil, err
+	}
+
+	coverages := map[types.GridCellIndexer][]antennaCoverage{}
+	for _, gridCell := range gridCells {
+		antenna, err := store.GetAntenna(gridCell.AntennaID)
+		if err != nil {
+			return nil, err
+		}
+		cell := types.GridCellIndexer{X: gridCell.X, Y: gridCell.Y}
+		coverages[cell] = append(coverages[cell], antennaCoverage{Antenna: antenna, GridCell: gridCell})
+	}
+
+	for _, cellCoverages := range coverages {
+		slices.SortStableFunc(cellCoverages, compareAntennaCoverage)
+	}
+	return coverages, nil
+}
+
+func compareAntennaCoverage(a antennaCoverage, b antennaCoverage) int {
+	if bucketOrder := cmp.Compare(getMaxBucket(a.GridCell), getMaxBucket(b.GridCell)); bucketOrder != 0 {
+		return bucketOrder
+	}
+	return cmp.Compare(gridCellMeasurementCount(b.GridCell), gridCellMeasurementCount(a.GridCell))
+}
+
+// The z19 cell a location falls in
+func locationZ19Cell(location coverageLocation) (int, int) {
+	return int(LonToTileX(location.Lon, 19)), int(LatToTileY(location.Lat, 19))
+}
+
+func validateCoverageLocation(location coverageLocation) error {
+	if math.IsNaN(location.Lat) || location.Lat < -mercatorMaxLat || location.Lat > mercatorMaxLat {
+		return errors.New("lat invalid")
+	}
+	// The east edge of the map is the west edge again
+	if math.IsNaN(location.Lon) || location.Lon < -180 || location.Lon >= 180 {
+		return errors.New("lon invalid")
+	}
+	return nil
+}
+
+// Parse a JSON array of locations, stopping after one location more than the maximum
+func parseCoverageJson(body io.Reader) ([]coverageLocation, error) {
+	decoder := json.NewDecoder(body)
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token != json.Delim('[') {
+		return nil, errors.New("expected an array")
+	}
+
+	locations := []coverageLocation{}
+	for decoder.More() && len(locations) <= coverageMaxLocations {
+		var location coverageLocation
+		err = decoder.Decode(&location)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, location)
+	}
+	return locations, nil
+}
+
+// Parse CSV locations, stopping after one location more than the maximum. The header row names the lat and lon
+// columns, and optionally an id column.
+func parseCoverageCsv(body io.Reader) ([]coverageLocation, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	latColumn, hasLat := columns["lat"]
+	lonColumn, hasLon := columns["lon"]
+	idColumn, hasId := columns["id"]
+	if !hasLat || !hasLon {
+		return nil, errors.New("header needs lat and lon columns")
+	}
+
+	locations := []coverageLocation{}
+	for len(locations) <= coverageMaxLocations {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) != len(header) {
+			return nil, fmt.Errorf("line %d: expected %d columns", len(locations)+2, len(header))
+		}
+
+		location := coverageLocation{}
+		if hasId {
+			location.Id = record[idColumn]
+		}
+		location.Lat, err = strconv.ParseFloat(record[latColumn], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: lat invalid", len(locations)+2)
+		}
+		location.Lon, err = strconv.ParseFloat(record[lonColumn], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: lon invalid", len(locations)+2)
+		}
+		locations = append(locations, location)
+	}
+
+	return locations, nil
+}
+
+func writeCoverageCsv(w http.ResponseWriter, responses []locationCoverageResponse) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	writer := csv.NewWriter(w)
+	_ = writer.Write([]string{"id", "lat", "lon", "covered", "gateway_id", "antenna_index", "bucket", "measurements"})
+	for _, response := range responses {
+		record := []string{
+			response.Id,
+			strconv.FormatFloat(response.Lat, 'f', -1, 64),
+			strconv.FormatFloat(response.Lon, 'f', -1, 64),
+			strconv.FormatBool(response.Covered),
+			"", "", "",
+			strconv.FormatUint(uint64(response.Measurements), 10),
+		}
+		if response.Covered {
+			record[4] = *response.GatewayId
+			record[5] = strconv.Itoa(int(*response.AntennaIndex))
+			record[6] = *response.Bucket
+		}
+		_ = writer.Write(record)
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Println(err.Error())
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type testCoverageResponse struct {
+	X        int                       `json:"x"`
+	Y        int                       `json:"y"`
+	Antennas []antennaCoverageResponse `json:"antennas"`
+}
+
+// Centre of a z19 cell
+func testCellLocation(x int, y int) (float64, float64) {
+	return TileYToLat(float64(y)+0.5, 19), TileXToLon(float64(x)+0.5, 19)
+}
+
+func TestGetCoverage(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	getCoverage := func(x int, y int, options string) []antennaCoverageResponse {
+		lat, lon := testCellLocation(x, y)
+		query := url.Values{"network_id": {testNetworkId}}
+		query.Set("lat", strconv.FormatFloat(lat, 'f', -1, 64))
+		query.Set("lon", strconv.FormatFloat(lon, 'f', -1, 64))
+		response := getTestResponse(t, server, "/api/coverage?"+query.Encode()+options, decodeTestJson[testCoverageResponse])
+		if response.X != x || response.Y != y {
+			t.Errorf("expected cell %d,%d, got %d,%d", x, y, response.X, response.Y)
+		}
+		return response.Antennas
+	}
+
+	// Both antennas of the gateway heard cell 289610,314730, the strongest comes first
+	antennas := getCoverage(289610, 314730, "")
+	if len(antennas) != 2 {
+		t.Fatalf("expected 2 antennas, got %v", antennas)
+	}
+	if antennas[0].GatewayId != testGatewayId || antennas[0].AntennaIndex != 0 || antennas[0].ModalBucket != "bucket_high" ||
+		antennas[0].Measurements != 6 || antennas[0].Buckets["bucket_100"] != 1 {
+		t.Errorf("unexpected first antenna %v", antennas[0])
+	}
+	if antennas[1].AntennaIndex != 1 || antennas[1].ModalBucket != "bucket_110" {
+		t.Errorf("unexpected second antenna %v", antennas[1])
+	}
+
+	// The first antenna heard the cell before the gateway moved
+	antennas = getCoverage(289610, 314730, "&since_install=true")
+	if len(antennas) != 1 || antennas[0].AntennaIndex != 1 {
+		t.Errorf("expected only the second antenna, got %v", antennas)
+	}
+
+	// Cell 289612,314732 was only heard by the offline gateway
+	if antennas = getCoverage(289612, 314732, ""); len(antennas) != 0 {
+		t.Errorf("expected no antennas, got %v", antennas)
+	}
+	if antennas = getCoverage(289612, 314732, "&include_offline=true"); len(antennas) != 1 || antennas[0].GatewayId != testOfflineGateway {
+		t.Errorf("expected the offline gateway, got %v", antennas)
+	}
+
+	for _, query := range []string{"?lat=-33.9&lon=18.8", "?network_id=thethingsnetwork.org&lat=-33.9",
+		"?network_id=thethingsnetwork.org&lat=89&lon=18.8", "?network_id=thethingsnetwork.org&lat=-33.9&lon=180"} {
+		resp, err := http.Get(server.URL + "/api/coverage" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", query, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
+
+func TestPostCoverage(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	coveredLat, coveredLon := testCellLocation(289620, 314740)
+	locations := []coverageLocation{
+		{Id: "meter-1", Lat: coveredLat, Lon: coveredLon},
+		{Id: "meter-2", Lat: 52.1, Lon: 5.1},
+	}
+	body, err := json.Marshal(locations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(server.URL+"/api/coverage?network_id="+url.QueryEscape(testNetworkId), "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responses []locationCoverageResponse
+	err = json.NewDecoder(resp.Body).Decode(&responses)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 2 {
+		t.Fatalf("expected 2 locations, got %v", responses)
+	}
+	if !responses[0].Covered || *responses[0].GatewayId != testGatewayId || *responses[0].Bucket != "bucket_105" || responses[0].Id != "meter-1" {
+		t.Errorf("unexpected covered location %v", responses[0])
+	}
+	if responses[1].Covered || responses[1].GatewayId != nil {
+		t.Errorf("unexpected uncovered location %v", responses[1])
+	}
+
+	// CSV is answered with CSV
+	csvBody := "id,lat,lon\nmeter-1," + strconv.FormatFloat(coveredLat, 'f', -1, 64) + "," + strconv.FormatFloat(coveredLon, 'f', -1, 64) + "\nmeter-2,52.1,5.1\n"
+	resp, err = http.Post(server.URL+"/api/coverage?network_id="+url.QueryEscape(testNetworkId), "text/csv", strings.NewReader(csvBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[1][0] != "meter-1" || records[1][3] != "true" || records[1][6] != "bucket_105" || records[2][3] != "false" {
+		t.Errorf("unexpected CSV response %v", records)
+	}
+
+	for _, test := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/csv", "id,latitude,longitude\nmeter-1,-33.9,18.8\n"},
+		{"text/csv", "lat,lon\nnorth,18.8\n"},
+		{"application/json", `{"lat": -33.9}`},
+		{"application/json", `[{"lat": -91, "lon": 18.8}]`},
+	} {
+		resp, err := http.Post(server.URL+"/api/coverage?network_id="+url.QueryEscape(testNetworkId), test.contentType, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", test.body, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+
+	// Too many locations, or too large a body
+	for _, test := range []struct {
+		body   string
+		status int
+	}{
+		{"lat,lon\n" + strings.Repeat("-33.9,18.8\n", coverageMaxLocations+1), http.StatusBadRequest},
+		{"id,lat,lon\n" + strings.Repeat("x", coverageMaxBodySize) + ",-33.9,18.8\n", http.StatusRequestEntityTooLarge},
+	} {
+		resp, err := http.Post(server.URL+"/api/coverage?network_id="+url.QueryEscape(testNetworkId), "text/csv", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("expected status %d, got %d", test.status, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"ttnmapper-tms/types"
+)
+
+// gridVertex is a corner of z19 grid cells
+type gridVertex struct {
+	X int
+	Y int
+}
+
+// GetGatewayFootprint returns the outline of the coverage of a gateway as a GeoJSON FeatureCollection. By default
+// there is one feature for all cells in which the gateway was heard. The thresholds query parameter asks for one
+// feature per bucket instead, each outlining the cells that are at least that strong. Every feature has the area
+// it covers in km².
+// Query parameters: optional comma separated thresholds like bucket_100,bucket_120, and the aggregation, since,
+// until and since_install options of the gateway tiles
+func (s *TileServer) GetGatewayFootprint(w http.ResponseWriter, r *http.Request) {
+	thresholds, err := GetRequestThresholds(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	gateway, mergedCells, aggregation, ok := s.getGatewayCoverage(w, r, "footprint")
+	if !ok {
+		return
+	}
+
+	bucketIndexes := map[types.GridCellIndexer]int{}
+	for _, mergedCell := range mergedCells {
+		bucketIndexes[types.GridCellIndexer{X: mergedCell.X, Y: mergedCell.Y}] = aggregation.BucketIndex(mergedCell.GridCell)
+	}
+
+	collection := types.GeoJsonFeatureCollection{Type: "FeatureCollection", Features: []types.GeoJsonFeature{}}
+	for _, threshold := range thresholds {
+		cells := map[types.GridCellIndexer]bool{}
+		for cell, bucketIndex := range bucketIndexes {
+			if bucketIndex <= threshold {
+				cells[cell] = true
+			}
+		}
+		feature := CreateFootprintFeature(cells)
+		feature.Properties["network_id"] = gateway.NetworkId
+		feature.Properties["gateway_id"] = gateway.GatewayId
+		feature.Properties["bucket"] = bucketNames[threshold]
+		collection.Features = append(collection.Features, feature)
+	}
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	err = json.NewEncoder(w).Encode(collection)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Return the bucket indexes selected by the thresholds query parameter, strongest first. Without it all heard cells
+// are outlined at once.
+func GetRequestThresholds(r *http.Request) ([]int, error) {
+	query := r.URL.Query()
+	if query.Get("thresholds") == "" {
+		return []int{len(bucketNames) - 2}, nil
+	}
+
+	var thresholds []int
+	for _, name := range strings.Split(query.Get("thresholds"), ",") {
+		bucketIndex := slices.Index(bucketNames[:len(bucketNames)-1], strings.TrimSpace(name))
+		if bucketIndex < 0 {
+			return nil, errors.New("thresholds invalid")
+		}
+		if !slices.Contains(thresholds, bucketIndex) {
+			thresholds = append(thresholds, bucketIndex)
+		}
+	}
+	slices.Sort(thresholds)
+	return thresholds, nil
+}
+
+// Create a (multi)polygon feature outlining z19 grid cells, with the number of cells and their area as properties
+func CreateFootprintFeature(cells map[types.GridCellIndexer]bool) types.GeoJsonFeature {
+	var area float64
+	for cell := range cells {
+		area += z19CellArea(cell.Y)
+	}
+
+	var polygons [][][][]float64
+	for _, polygon := range traceGridCellPolygons(cells) {
+		var rings [][][]float64
+		for _, ring := range polygon {
+			coordinates := make([][]float64, 0, len(ring)+1)
+			for _, vertex := range append(ring, ring[0]) {
+				coordinates = append(coordinates, []float64{TileXToLon(float64(vertex.X), 19), TileYToLat(float64(vertex.Y), 19)})
+			}
+			rings = append(rings, coordinates)
+		}
+		polygons = append(polygons, rings)
+	}
+
+	geometry := types.GeoJsonGeometry{Type: "MultiPolygon", Coordinates: polygons}
+	if len(polygons) == 1 {
+		geometry = types.GeoJsonGeometry{Type: "Polygon", Coordinates: polygons[0]}
+	} else if len(polygons) == 0 {
+		geometry.Coordinates = [][][][]float64{}
+	}
+
+	return types.GeoJsonFeature{
+		Type:     "Feature",
+		Geometry: geometry,
+		Properties: map[string]interface{}{
+			"cells":    len(cells),
+			"area_km2": area,
+		},
+	}
+}
+
+// Trace the outlines of a set of grid cells. Returns polygons of which the first ring is the outer boundary,
+// counterclockwise on the map, followed by the holes in it, clockwise. Only the corners of the rings are kept.
+func traceGridCellPolygons(cells map[types.GridCellIndexer]bool) [][][]gridVertex {
+	// The sides of the cells that border on a cell outside the set, directed so that the cell is on their left on the
+	// map. As y grows southwards that is on their right in grid coordinates.
+	edges := map[gridVertex][]gridVertex{}
+	addEdge := func(fromX int, fromY int, toX int, toY int) {
+		from := gridVertex{X: fromX, Y: fromY}
+		edges[from] = append(edges[from], gridVertex{X: toX, Y: toY})
+	}
+	for cell := range cells {
+		x, y := cell.X, cell.Y
+		if !cells[types.GridCellIndexer{X: x - 1, Y: y}] {
+			addEdge(x, y, x, y+1)
+		}
+		if !cells[types.GridCellIndexer{X: x, Y: y + 1}] {
+			addEdge(x, y+1, x+1, y+1)
+		}
+		if !cells[types.GridCellIndexer{X: x + 1, Y: y}] {
+			addEdge(x+1, y+1, x+1, y)
+		}
+		if !cells[types.GridCellIndexer{X: x, Y: y - 1}] {
+			addEdge(x+1, y, x, y)
+		}
+	}
+
+	// Start the rings in a fixed order, so that the same cells always give the same outline
+	starts := make([]gridVertex, 0, len(edges))
+	for vertex := range edges {
+		starts = append(starts, vertex)
+	}
+	slices.SortFunc(starts, func(a, b gridVertex) int {
+		if a.Y != b.Y {
+			return a.Y - b.Y
+		}
+		return a.X - b.X
+	})
+
+	var outers, holes [][]gridVertex
+	for _, start := range starts {
+		for len(edges[start]) > 0 {
+			ring := traceRing(edges, start)
+			if ringSignedArea(ring) > 0 {
+				outers = append(outers, ring)
+			} else {
+				holes = append(holes, ring)
+			}
+		}
+	}
+
+	polygons := make([][][]gridVertex, len(outers))
+	for i, outer := range outers {
+		polygons[i] = [][]gridVertex{outer}
+	}
+	for _, hole := range holes {
+		// The cell on the left of the first side of a hole is inside the polygon the hole is in. Outlines can be nested,
+		// so that is the smallest outer ring around it.
+		dx, dy := sign(hole[1].X-hole[0].X), sign(hole[1].Y-hole[0].Y)
+		centreX := float64(hole[0].X) + float64(dx+dy)/2
+		centreY := float64(hole[0].Y) + float64(dy-dx)/2
+		polygon := -1
+		for i, outer := range outers {
+			if ringContains(outer, centreX, centreY) && (polygon < 0 || ringSignedArea(outer) < ringSignedArea(outers[polygon])) {
+				polygon = i
+			}
+		}
+		if polygon >= 0 {
+			polygons[polygon] = append(polygons[polygon], hole)
+		}
+	}
+
+	return polygons
+}
+
+// Follow the edges from start until the ring is closed, removing them from the graph. Where two cells only touch at
+// a corner the leftmost turn is taken, so that they get separate rings.
+func traceRing(edges map[gridVertex][]gridVertex, start gridVertex) []gridVertex {
+	var ring []gridVertex
+	from := start
+	var dx, dy int
+	for {
+		outgoing := edges[from]
+		next := 0
+		if len(outgoing) > 1 && len(ring) > 0 {
+			for i, to := range outgoing {
+				// A left turn on the map is a turn to dy,-dx in grid coordinates
+				if sign(to.X-from.X) == dy && sign(to.Y-from.Y) == -dx {
+					next = i
+				}
+			}
+		}
+		to := outgoing[next]
+		edges[from] = append(outgoing[:next], outgoing[next+1:]...)
+		if len(edges[from]) == 0 {
+			delete(edges, from)
+		}
+
+		// Only keep the corners
+		newDx, newDy := sign(to.X-from.X), sign(to.Y-from.Y)
+		if len(ring) == 0 || newDx != dx || newDy != dy {
+			ring = append(ring, from)
+		}
+		dx, dy = newDx, newDy
+
+		from = to
+		if from == start {
+			break
+		}
+	}
+
+	// The start is not a corner if the ring ends in the direction it started
+	if len(ring) > 2 && sign(ring[1].X-ring[0].X) == dx && sign(ring[1].Y-ring[0].Y) == dy {
+		ring = ring[1:]
+	}
+	return ring
+}
+
+// Twice the area of a ring on the map, positive if it is counterclockwise
+func ringSignedArea(ring []gridVertex) int {
+	area := 0
+	for i, from := range ring {
+		to := ring[(i+1)%len(ring)]
+		// y grows southwards, so the sign flips
+		area -= from.X*to.Y - to.X*from.Y
+	}
+	return area
+}
+
+// Check if a point that is not on a grid line lies inside a ring
+func ringContains(ring []gridVertex, x float64, y float64) bool {
+	inside := false
+	for i, from := range ring {
+		to := ring[(i+1)%len(ring)]
+		if from.X != to.X || float64(from.X) < x {
+			continue
+		}
+		if (float64(from.Y) < y) != (float64(to.Y) < y) {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func sign(value int) int {
+	switch {
+	case value > 0:
+		return 1
+	case value < 0:
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"ttnmapper-tms/types"
+)
+
+// Parse cells drawn as rows of characters, with # for a cell in the set
+func testGridCells(rows ...string) map[types.GridCellIndexer]bool {
+	cells := map[types.GridCellIndexer]bool{}
+	for y, row := range rows {
+		for x, char := range row {
+			if char == '#' {
+				cells[types.GridCellIndexer{X: x, Y: y}] = true
+			}
+		}
+	}
+	return cells
+}
+
+func TestTraceGridCellPolygons(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// The number of corners of the rings of each polygon
+		expected [][]int
+		cells    map[types.GridCellIndexer]bool
+	}{
+		{"square", [][]int{{4}}, testGridCells("##", "##")},
+		{"L shape", [][]int{{6}}, testGridCells("#.", "##")},
+		{"hole", [][]int{{4, 4}}, testGridCells("###", "#.#", "###")},
+		{"diagonal", [][]int{{4}, {4}}, testGridCells("#.", ".#")},
+		{"island in hole", [][]int{{4, 4}, {4}}, testGridCells("#####", "#...#", "#.#.#", "#...#", "#####")},
+	} {
+		polygons := traceGridCellPolygons(test.cells)
+		if len(polygons) != len(test.expected) {
+			t.Errorf("%s: expected %d polygons, got %v", test.name, len(test.expected), polygons)
+			continue
+		}
+		for i, polygon := range polygons {
+			if len(polygon) != len(test.expected[i]) {
+				t.Errorf("%s: expected %d rings in polygon %d, got %v", test.name, len(test.expected[i]), i, polygon)
+				continue
+			}
+			for j, ring := range polygon {
+				if len(ring) != test.expected[i][j] {
+					t.Errorf("%s: expected %d corners in ring %d of polygon %d, got %v", test.name, test.expected[i][j], j, i, ring)
+				}
+				// Outer rings are counterclockwise, holes clockwise
+				if area := ringSignedArea(ring); (j == 0) != (area > 0) {
+					t.Errorf("%s: ring %d of polygon %d has the wrong orientation %v", test.name, j, i, ring)
+				}
+			}
+		}
+	}
+}
+
+func TestGetGatewayFootprint(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	path := "/api/gateway/" + url.QueryEscape(testNetworkId) + "/" + testGatewayId + "/footprint.geojson"
+	getFootprint := func(query string) types.GeoJsonFeatureCollection {
+		return getTestResponse(t, server, path+query, decodeTestJson[types.GeoJsonFeatureCollection])
+	}
+
+	// The three cells of the gateway do not touch
+	collection := getFootprint("")
+	if len(collection.Features) != 1 {
+		t.Fatalf("expected 1 feature, got %v", collection.Features)
+	}
+	feature := collection.Features[0]
+	if feature.Geometry.Type != "MultiPolygon" || len(feature.Geometry.Coordinates.([]interface{})) != 3 {
+		t.Errorf("expected a multipolygon of 3 cells, got %v", feature.Geometry)
+	}
+	if feature.Properties["cells"] != 3.0 || feature.Properties["bucket"] != "bucket_low" {
+		t.Errorf("unexpected properties %v", feature.Properties)
+	}
+	expectedArea := z19CellArea(314730)*2 + z19CellArea(314740)
+	if area := feature.Properties["area_km2"].(float64); area < expectedArea*0.999 || area > expectedArea*1.001 {
+		t.Errorf("expected area %f, got %f", expectedArea, area)
+	}
+
+	// One feature per threshold, strongest first
+	collection = getFootprint("?thresholds=bucket_110,bucket_105")
+	if len(collection.Features) != 2 {
+		t.Fatalf("expected 2 features, got %v", collection.Features)
+	}
+	if collection.Features[0].Properties["bucket"] != "bucket_105" || collection.Features[0].Properties["cells"] != 1.0 ||
+		collection.Features[0].Geometry.Type != "Polygon" {
+		t.Errorf("unexpected first feature %v", collection.Features[0])
+	}
+	if collection.Features[1].Properties["bucket"] != "bucket_110" || collection.Features[1].Properties["cells"] != 2.0 {
+		t.Errorf("unexpected second feature %v", collection.Features[1])
+	}
+
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{path + "?thresholds=bucket_no_signal", http.StatusBadRequest},
+		{path + "?thresholds=strong", http.StatusBadRequest},
+		{"/api/gateway/" + url.QueryEscape(testNetworkId) + "/" + testBlacklistGateway + "/footprint.geojson", http.StatusNotFound},
+	} {
+		resp, err := http.Get(server.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.path, test.status, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"ttnmapper-tms/types"
+)
+
+// Mean radius of the earth in metres
+const earthRadius = 6371008.8
+
+type bucketStatsResponse struct {
+	Bucket  string  `json:"bucket"`
+	Cells   int     `json:"cells"`
+	AreaKm2 float64 `json:"area_km2"`
+}
+
+type boundingBoxResponse struct {
+	MinLon float64 `json:"min_lon"`
+	MinLat float64 `json:"min_lat"`
+	MaxLon float64 `json:"max_lon"`
+	MaxLat float64 `json:"max_lat"`
+}
+
+type gatewayStatsResponse struct {
+	NetworkId    string                `json:"network_id"`
+	GatewayId    string                `json:"gateway_id"`
+	Latitude     float64               `json:"latitude"`
+	Longitude    float64               `json:"longitude"`
+	Cells        int                   `json:"cells"`
+	AreaKm2      float64               `json:"area_km2"`
+	Buckets      []bucketStatsResponse `json:"buckets"`
+	Measurements uint                  `json:"measurements"`
+	MaxDistance  float64               `json:"max_distance_m"`
+	BoundingBox  *boundingBoxResponse  `json:"bbox"`
+}
+
+// GetGatewayStats summarises the coverage of a gateway: the number of z19 cells and their area per signal bucket,
+// the number of measurements, the distance to the farthest cell in which the gateway was heard and the bounding box
+// of those cells.
+// Query parameters: the aggregation, since, until and since_install options of the gateway tiles
+func (s *TileServer) GetGatewayStats(w http.ResponseWriter, r *http.Request) {
+	gateway, mergedCells, aggregation, ok := s.getGatewayCoverage(w, r, "stats")
+	if !ok {
+		return
+	}
+
+	writeJson(w, CalculateGatewayStats(gateway, mergedCells, aggregation))
+}
+
+// Return the gateway of a request for the coverage of one gateway, with all its grid cells selected by the
+// aggregation, since, until and since_install options. On invalid requests an error is sent and false returned.
+func (s *TileServer) getGatewayCoverage(w http.ResponseWriter, r *http.Request, name string) (types.Gateway, []types.MergedGridCell, CellAggregation, bool) {
+	vars := mux.Vars(r)
+
+	// Network IDs like NS_TTS_V3://ttn@000013 are passed url encoded
+	networkId, err := url.QueryUnescape(vars["network_id"])
+	if err != nil {
+		http.Error(w, "network_id invalid", http.StatusBadRequest)
+		return types.Gateway{}, nil, CellAggregation{}, false
+	}
+	gatewayId, err := url.QueryUnescape(vars["gateway_id"])
+	if err != nil {
+		http.Error(w, "gateway_id invalid", http.StatusBadRequest)
+		return types.Gateway{}, nil, CellAggregation{}, false
+	}
+
+	tileRequest := TileRequest{NetworkId: networkId, GatewayId: gatewayId, SingleGateway: true}
+
+	aggregation, err := GetRequestAggregation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return types.Gateway{}, nil, aggregation, false
+	}
+	tileRequest.Window, err = GetRequestTimeWindow(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return types.Gateway{}, nil, aggregation, false
+	}
+	tileRequest.SinceInstall, err = GetRequestSinceInstall(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return types.Gateway{}, nil, aggregation, false
+	}
+
+	log.Printf("Gateway %s %s/%s\t", name, networkId, gatewayId)
+
+	gateway, found, err := s.store.GetGateway(networkId, gatewayId)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return gateway, nil, aggregation, false
+	}
+	if !found {
+		http.Error(w, "gateway not found", http.StatusNotFound)
+		return gateway, nil, aggregation, false
+	}
+
+	sinceInstall, err := ApplySinceInstall(s.store, &tileRequest)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return gateway, nil, aggregation, false
+	}
+	if sinceInstall != "" {
+		w.Header().Set("X-Since-Install", sinceInstall)
+	}
+
+	maxIndex := 1<<19 - 1
+	mergedCells, err := GetGatewayMergedCellsInRange(s.store, networkId, gatewayId, 0, 0, maxIndex, maxIndex, tileRequest.Window)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return gateway, nil, aggregation, false
+	}
+
+	return gateway, mergedCells, aggregation, true
+}
+
+// Sum the cells of a gateway per bucket. Cells in which the gateway was never heard count towards the no signal
+// bucket, but not towards the distance and bounding box. Whether a cell was heard does not depend on the
+// aggregation, so a cell with mostly no signal measurements still counts towards the reach of the gateway.
+func CalculateGatewayStats(gateway types.Gateway, mergedCells []types.MergedGridCell, aggregation CellAggregation) gatewayStatsResponse {
+	stats := gatewayStatsResponse{
+		NetworkId: gateway.NetworkId,
+		GatewayId: gateway.GatewayId,
+		Latitude:  gateway.Latitude,
+		Longitude: gateway.Longitude,
+		Cells:     len(mergedCells),
+	}
+
+	var bucketCells [len(bucketNames)]int
+	var bucketArea [len(bucketNames)]float64
+	for _, mergedCell := range mergedCells {
+		gridCell := mergedCell.GridCell
+		bucketIndex := aggregation.BucketIndex(gridCell)
+		area := z19CellArea(gridCell.Y)
+
+		bucketCells[bucketIndex]++
+		bucketArea[bucketIndex] += area
+		stats.AreaKm2 += area
+		stats.Measurements += gridCellMeasurementCount(gridCell)
+
+		// The best bucket is only no signal if none of the measurements were heard
+		if getBestBucket(gridCell) == len(bucketNames)-1 {
+			continue
+		}
+
+		west, east := TileXToLon(float64(gridCell.X), 19), TileXToLon(float64(gridCell.X+1), 19)
+		north, south := TileYToLat(float64(gridCell.Y), 19), TileYToLat(float64(gridCell.Y+1), 19)
+		if stats.BoundingBox == nil {
+			stats.BoundingBox = &boundingBoxResponse{MinLon: west, MinLat: south, MaxLon: east, MaxLat: north}
+		} else {
+			stats.BoundingBox.MinLon = math.Min(stats.BoundingBox.MinLon, west)
+			stats.BoundingBox.MinLat = math.Min(stats.BoundingBox.MinLat, south)
+			stats.BoundingBox.MaxLon = math.Max(stats.BoundingBox.MaxLon, east)
+			stats.BoundingBox.MaxLat = math.Max(stats.BoundingBox.MaxLat, north)
+		}
+
+		distance := distanceMetres(gateway.Latitude, gateway.Longitude, (north+south)/2, (west+east)/2)
+		stats.MaxDistance = math.Max(stats.MaxDistance, distance)
+	}
+
+	stats.Buckets = []bucketStatsResponse{}
+	for bucketIndex, name := range bucketNames {
+		if bucketCells[bucketIndex] == 0 {
+			continue
+		}
+		stats.Buckets = append(stats.Buckets, bucketStatsResponse{Bucket: name, Cells: bucketCells[bucketIndex], AreaKm2: bucketArea[bucketIndex]})
+	}
+
+	return stats
+}
+
+// Area in km² of the z19 cells in row y. Web mercator cells are square on the map, but shrink towards the poles.
+func z19CellArea(y int) float64 {
+	north := TileYToLat(float64(y), 19) * math.Pi / 180
+	south := TileYToLat(float64(y+1), 19) * math.Pi / 180
+	width := 2 * math.Pi / math.Exp2(19)
+	radius := earthRadius / 1000
+	return radius * radius * width * (math.Sin(north) - math.Sin(south))
+}
+
+// Great circle distance in metres between two points
+func distanceMetres(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	phi1, phi2 := lat1*math.Pi/180, lat2*math.Pi/180
+	deltaPhi := phi2 - phi1
+	deltaLambda := (lon2 - lon1) * math.Pi / 180
+
+	a := math.Sin(deltaPhi/2)*math.Sin(deltaPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(deltaLambda/2)*math.Sin(deltaLambda/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
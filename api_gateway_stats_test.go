@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"ttnmapper-tms/types"
+)
+
+func TestGetGatewayStats(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	path := "/api/gateway/" + url.QueryEscape(testNetworkId) + "/" + testGatewayId + "/stats"
+
+	// Cell 289610,314730 of the first antenna is from before the gateway moved, so only the second antenna is counted there
+	stats := getTestResponse(t, server, path, decodeTestJson[gatewayStatsResponse])
+	if stats.Cells != 3 || stats.Measurements != 15 {
+		t.Errorf("expected 3 cells with 15 measurements, got %d with %d", stats.Cells, stats.Measurements)
+	}
+	expectedBuckets := map[string]int{"bucket_110": 1, "bucket_105": 1, "bucket_low": 1}
+	if len(stats.Buckets) != len(expectedBuckets) {
+		t.Fatalf("unexpected buckets %v", stats.Buckets)
+	}
+	for _, bucket := range stats.Buckets {
+		if bucket.Cells != expectedBuckets[bucket.Bucket] {
+			t.Errorf("unexpected bucket %v", bucket)
+		}
+	}
+
+	// The farthest cell is 289700,314730
+	expectedDistance := distanceMetres(stats.Latitude, stats.Longitude, TileYToLat(314730.5, 19), TileXToLon(289700.5, 19))
+	if math.Abs(stats.MaxDistance-expectedDistance) > 1 {
+		t.Errorf("expected max distance %f, got %f", expectedDistance, stats.MaxDistance)
+	}
+	if stats.BoundingBox == nil || stats.BoundingBox.MaxLon != TileXToLon(289701, 19) || stats.BoundingBox.MinLat != TileYToLat(314741, 19) {
+		t.Errorf("unexpected bbox %v", stats.BoundingBox)
+	}
+
+	stats = getTestResponse(t, server, path+"?since_install=false", decodeTestJson[gatewayStatsResponse])
+	if stats.Cells != 3 || stats.Measurements != 21 || stats.Buckets[0].Bucket != "bucket_high" {
+		t.Errorf("unexpected stats without since_install %v", stats)
+	}
+
+	// Outside the window there is no coverage
+	stats = getTestResponse(t, server, path+"?since=2022-01-01", decodeTestJson[gatewayStatsResponse])
+	if stats.Cells != 0 || len(stats.Buckets) != 0 || stats.BoundingBox != nil {
+		t.Errorf("expected no coverage, got %v", stats)
+	}
+
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{"/api/gateway/" + url.QueryEscape(testNetworkId) + "/" + testBlacklistGateway + "/stats", http.StatusNotFound},
+		{"/api/gateway/" + url.QueryEscape(testNetworkId) + "/eui-unknown/stats", http.StatusNotFound},
+		{path + "?since=yesterday", http.StatusBadRequest},
+		{path + "?aggregation=median", http.StatusBadRequest},
+	} {
+		resp, err := http.Get(server.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.path, test.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestCalculateGatewayStatsHeard(t *testing.T) {
+	gateway := types.Gateway{NetworkId: testNetworkId, GatewayId: testGatewayId, Latitude: TileYToLat(314730.5, 19), Longitude: TileXToLon(289610.5, 19)}
+
+	// The far cell was heard once, but its modal bucket is no signal
+	mergedCells := []types.MergedGridCell{
+		{GridCell: types.GridCell{X: 289610, Y: 314730, BucketHigh: 2}},
+		{GridCell: types.GridCell{X: 289700, Y: 314730, BucketLow: 1, BucketNoSignal: 5}},
+		{GridCell: types.GridCell{X: 289800, Y: 314730, BucketNoSignal: 5}},
+	}
+	expectedDistance := distanceMetres(gateway.Latitude, gateway.Longitude, TileYToLat(314730.5, 19), TileXToLon(289700.5, 19))
+
+	for _, aggregation := range []CellAggregation{{}, {Mode: AggregationBest}, {Mode: AggregationPercentile, Percentile: 10}} {
+		stats := CalculateGatewayStats(gateway, mergedCells, aggregation)
+		if math.Abs(stats.MaxDistance-expectedDistance) > 1 {
+			t.Errorf("%v: expected max distance %f, got %f", aggregation, expectedDistance, stats.MaxDistance)
+		}
+		if stats.BoundingBox == nil || stats.BoundingBox.MaxLon != TileXToLon(289701, 19) {
+			t.Errorf("%v: unexpected bbox %v", aggregation, stats.BoundingBox)
+		}
+	}
+}
+
+func TestZ19CellArea(t *testing.T) {
+	// At the equator a cell is about 76 m wide
+	area := z19CellArea(1 << 18)
+	if math.Abs(area-0.00584) > 0.0001 {
+		t.Errorf("unexpected area at the equator %f", area)
+	}
+
+	// At 60 degrees a cell covers a quarter of that
+	y := int(LatToTileY(60, 19))
+	if math.Abs(z19CellArea(y)/area-0.25) > 0.001 {
+		t.Errorf("unexpected area at 60 degrees %f", z19CellArea(y))
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+	"ttnmapper-tms/types"
+)
+
+// GetGatewaysGeoJson returns the gateways inside a bounding box as a GeoJSON FeatureCollection of points.
+// Query parameters: network_id and bbox=minLon,minLat,maxLon,maxLat
+func (s *TileServer) GetGatewaysGeoJson(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	networkId := query.Get("network_id")
+	if networkId == "" {
+		http.Error(w, "network_id required", http.StatusBadRequest)
+		return
+	}
+
+	boundingBox, err := ParseBoundingBox(query.Get("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Gateways GeoJSON %s: %v\t", networkId, boundingBox)
+
+	gateways, err := s.store.GetGatewaysInBoundingBox(networkId, boundingBox)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	collection := types.GeoJsonFeatureCollection{Type: "FeatureCollection", Features: []types.GeoJsonFeature{}}
+	for _, gateway := range gateways {
+		collection.Features = append(collection.Features, CreateGatewayFeature(gateway))
+	}
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	err = json.NewEncoder(w).Encode(collection)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Create a point feature for a gateway, with its online status using the same threshold as the coverage tiles
+func CreateGatewayFeature(gateway types.Gateway) types.GeoJsonFeature {
+	return types.GeoJsonFeature{
+		Type: "Feature",
+		Geometry: types.GeoJsonGeometry{
+			Type:        "Point",
+			Coordinates: []float64{gateway.Longitude, gateway.Latitude},
+		},
+		Properties: map[string]interface{}{
+			"network_id":  gateway.NetworkId,
+			"gateway_id":  gateway.GatewayId,
+			"description": gateway.Description,
+			"altitude":    gateway.Altitude,
+			"last_heard":  gateway.LastHeard.UTC().Format(time.RFC3339),
+			"online":      LastHeardOnline(gateway.LastHeard),
+		},
+	}
+}
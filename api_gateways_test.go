@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"ttnmapper-tms/types"
+)
+
+func TestGetGatewaysGeoJson(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	collection := getTestResponse(t, server, "/api/gateways.geojson?network_id="+url.QueryEscape(testNetworkId)+"&bbox="+testTileBbox(), decodeTestJson[types.GeoJsonFeatureCollection])
+
+	// The gateway forced to 0,0 is left out
+	online := map[string]bool{}
+	for _, feature := range collection.Features {
+		online[feature.Properties["gateway_id"].(string)] = feature.Properties["online"].(bool)
+	}
+	if len(online) != 2 || !online[testGatewayId] || online[testOfflineGateway] {
+		t.Errorf("unexpected gateways %v", online)
+	}
+}
+
+func TestGetGatewaysGeoJsonInvalid(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	for _, query := range []string{
+		"network_id=" + url.QueryEscape(testNetworkId) + "&bbox=1,2,3",
+		"bbox=" + testTileBbox(),
+	} {
+		resp, err := http.Get(server.URL + "/api/gateways.geojson?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", query, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
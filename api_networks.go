@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Number of items in a page of the discovery endpoints, unless the limit query parameter asks for fewer or more
+const (
+	listDefaultLimit = 100
+	listMaxLimit     = 1000
+)
+
+type networkResponse struct {
+	NetworkId    string `json:"network_id"`
+	GatewayCount int    `json:"gateway_count"`
+}
+
+type gatewayResponse struct {
+	GatewayId    string  `json:"gateway_id"`
+	GatewayEui   *string `json:"gateway_eui"`
+	Description  *string `json:"description"`
+	Latitude     float64 `json:"latitude"`
+	Longitude    float64 `json:"longitude"`
+	Altitude     int32   `json:"altitude"`
+	LastHeard    string  `json:"last_heard"`
+	Online       bool    `json:"online"`
+	AntennaCount int     `json:"antenna_count"`
+}
+
+// GetNetworks lists the networks that have gateways, so that clients do not need to know network IDs beforehand.
+// Query parameters: optional prefix of the network ID, limit and offset
+func (s *TileServer) GetNetworks(w http.ResponseWriter, r *http.Request) {
+	listQuery, err := GetRequestListQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Select one more than the page holds to know if there is a next page
+	pageQuery := listQuery
+	pageQuery.Limit++
+	networks, err := s.store.GetNetworks(pageQuery)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Networks   []networkResponse `json:"networks"`
+		NextOffset *int              `json:"next_offset,omitempty"`
+	}{Networks: []networkResponse{}}
+
+	if len(networks) > listQuery.Limit {
+		networks = networks[:listQuery.Limit]
+		nextOffset := listQuery.Offset + listQuery.Limit
+		response.NextOffset = &nextOffset
+	}
+	for _, network := range networks {
+		response.Networks = append(response.Networks, networkResponse{NetworkId: network.NetworkId, GatewayCount: network.GatewayCount})
+	}
+
+	writeJson(w, response)
+}
+
+// GetNetworkGateways lists the gateways of a network, at their forced location and without blacklisted gateways.
+// Query parameters: optional prefix of the gateway ID, bbox=minLon,minLat,maxLon,maxLat, limit and offset
+func (s *TileServer) GetNetworkGateways(w http.ResponseWriter, r *http.Request) {
+	// Network IDs like NS_TTS_V3://ttn@000013 are passed url encoded
+	networkId, err := url.QueryUnescape(mux.Vars(r)["network_id"])
+	if err != nil {
+		http.Error(w, "network_id invalid", http.StatusBadRequest)
+		return
+	}
+
+	listQuery, err := GetRequestListQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var boundingBox *BoundingBox
+	if bbox := r.URL.Query().Get("bbox"); bbox != "" {
+		parsed, err := ParseBoundingBox(bbox)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		boundingBox = &parsed
+	}
+
+	pageQuery := listQuery
+	pageQuery.Limit++
+	gateways, err := s.store.GetNetworkGateways(networkId, boundingBox, pageQuery)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		NetworkId  string            `json:"network_id"`
+		Gateways   []gatewayResponse `json:"gateways"`
+		NextOffset *int              `json:"next_offset,omitempty"`
+	}{NetworkId: networkId, Gateways: []gatewayResponse{}}
+
+	if len(gateways) > listQuery.Limit {
+		gateways = gateways[:listQuery.Limit]
+		nextOffset := listQuery.Offset + listQuery.Limit
+		response.NextOffset = &nextOffset
+	}
+	for _, gateway := range gateways {
+		response.Gateways = append(response.Gateways, gatewayResponse{
+			GatewayId:    gateway.GatewayId,
+			GatewayEui:   gateway.GatewayEui,
+			Description:  gateway.Description,
+			Latitude:     gateway.Latitude,
+			Longitude:    gateway.Longitude,
+			Altitude:     gateway.Altitude,
+			LastHeard:    gateway.LastHeard.UTC().Format(time.RFC3339),
+			Online:       LastHeardOnline(gateway.LastHeard),
+			AntennaCount: gateway.AntennaCount,
+		})
+	}
+
+	writeJson(w, response)
+}
+
+// Return the page selected by the prefix, limit and offset query parameters
+func GetRequestListQuery(r *http.Request) (ListQuery, error) {
+	query := r.URL.Query()
+	listQuery := ListQuery{Prefix: query.Get("prefix"), Limit: listDefaultLimit}
+
+	var err error
+	if query.Has("limit") {
+		listQuery.Limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || listQuery.Limit < 1 || listQuery.Limit > listMaxLimit {
+			return listQuery, errors.New("limit invalid")
+		}
+	}
+	if query.Has("offset") {
+		listQuery.Offset, err = strconv.Atoi(query.Get("offset"))
+		if err != nil || listQuery.Offset < 0 {
+			return listQuery, errors.New("offset invalid")
+		}
+	}
+
+	return listQuery, nil
+}
+
+// Write a JSON response. The discovery endpoints are public, so web maps on other origins may read them.
+func writeJson(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
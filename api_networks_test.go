@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+type testListResponse struct {
+	Networks   []networkResponse `json:"networks"`
+	Gateways   []gatewayResponse `json:"gateways"`
+	NextOffset *int              `json:"next_offset"`
+}
+
+func TestGetNetworks(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	response := getTestResponse(t, server, "/api/networks", decodeTestJson[testListResponse])
+	if len(response.Networks) != 2 || response.NextOffset != nil {
+		t.Fatalf("unexpected networks %v", response)
+	}
+	if response.Networks[0].NetworkId != testV3NetworkId || response.Networks[1].NetworkId != testNetworkId {
+		t.Errorf("networks not ordered by ID: %v", response.Networks)
+	}
+	// The blacklisted gateway is not counted
+	if response.Networks[1].GatewayCount != 2 {
+		t.Errorf("expected 2 gateways in %s, got %d", testNetworkId, response.Networks[1].GatewayCount)
+	}
+
+	// Paging
+	response = getTestResponse(t, server, "/api/networks?limit=1", decodeTestJson[testListResponse])
+	if len(response.Networks) != 1 || response.NextOffset == nil || *response.NextOffset != 1 {
+		t.Errorf("unexpected first page %v", response)
+	}
+	response = getTestResponse(t, server, "/api/networks?limit=1&offset=1", decodeTestJson[testListResponse])
+	if len(response.Networks) != 1 || response.Networks[0].NetworkId != testNetworkId || response.NextOffset != nil {
+		t.Errorf("unexpected second page %v", response)
+	}
+
+	response = getTestResponse(t, server, "/api/networks?prefix=NS_TTS", decodeTestJson[testListResponse])
+	if len(response.Networks) != 1 || response.Networks[0].NetworkId != testV3NetworkId {
+		t.Errorf("unexpected networks for prefix %v", response.Networks)
+	}
+}
+
+func TestGetNetworkGateways(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	// The blacklisted gateway is left out
+	response := getTestResponse(t, server, "/api/networks/"+url.QueryEscape(testNetworkId)+"/gateways", decodeTestJson[testListResponse])
+	if len(response.Gateways) != 2 {
+		t.Fatalf("expected 2 gateways, got %v", response.Gateways)
+	}
+	offline, online := response.Gateways[0], response.Gateways[1]
+	if offline.GatewayId != testOfflineGateway || offline.Online || offline.AntennaCount != 1 || offline.Latitude != -33.934 {
+		t.Errorf("unexpected offline gateway %v", offline)
+	}
+	if online.GatewayId != testGatewayId || !online.Online || online.AntennaCount != 2 {
+		t.Errorf("unexpected online gateway %v", online)
+	}
+
+	response = getTestResponse(t, server, "/api/networks/"+url.QueryEscape(testNetworkId)+"/gateways?prefix=eui-60c5", decodeTestJson[testListResponse])
+	if len(response.Gateways) != 1 || response.Gateways[0].GatewayId != testGatewayId {
+		t.Errorf("unexpected gateways for prefix %v", response.Gateways)
+	}
+
+	response = getTestResponse(t, server, "/api/networks/"+url.QueryEscape(testV3NetworkId)+"/gateways?bbox=0,0,1,1", decodeTestJson[testListResponse])
+	if len(response.Gateways) != 0 {
+		t.Errorf("expected no gateways outside bbox, got %v", response.Gateways)
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=1001", "?offset=-1", "?bbox=1,2,3"} {
+		resp, err := http.Get(server.URL + "/api/networks/" + url.QueryEscape(testNetworkId) + "/gateways" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", query, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// When the invalidator removes tiles as soon as their data changes, cached tiles only need to expire
+// for changes that are not in grid_cells, like gateways going offline. Keep them this many times longer.
+const invalidatedCacheDurationFactor = 7
+
+// Grid cells can be committed this long after their LastUpdated, by a long running transaction or a database clock
+// that is behind. Every scan looks back this far from the newest update of the previous scan.
+const cacheInvalidationOverlap = 10 * time.Minute
+
+// CacheInvalidator removes cached tiles that contain grid cells updated since its previous scan
+type CacheInvalidator struct {
+	store SampleStore
+	// The newest LastUpdated seen so far, by the clock of the database
+	lastScan time.Time
+	// The updates found by the previous scan, so that the overlapping scan does not remove their tiles again
+	seen map[cachedCellUpdate]bool
+}
+
+type cachedCellUpdate struct {
+	NetworkId   string
+	GatewayId   string
+	X           int
+	Y           int
+	LastUpdated int64
+}
+
+type cachedTileIndexer struct {
+	NetworkId string
+	GatewayId string
+	Z         int
+	X         int
+	Y         int
+}
+
+func NewCacheInvalidator(store SampleStore, lastScan time.Time) *CacheInvalidator {
+	return &CacheInvalidator{store: store, lastScan: lastScan, seen: map[cachedCellUpdate]bool{}}
+}
+
+// Scan for updated grid cells at every interval. This never returns.
+func (c *CacheInvalidator) Run(interval time.Duration) {
+	for {
+		removed, err := c.Scan()
+		if err != nil {
+			log.Println("Cache invalidation failed: " + err.Error())
+		} else if removed > 0 {
+			log.Printf("Cache invalidation removed %d tiles\n", removed)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Remove all cached tiles, at every zoom level, style and scale, that contain a grid cell updated since the previous scan.
+// Returns the number of tiles removed.
+func (c *CacheInvalidator) Scan() (int, error) {
+	updates, err := c.store.GetGridCellUpdatesSince(c.lastScan.Add(-cacheInvalidationOverlap))
+	if err != nil {
+		return 0, err
+	}
+
+	// Many cells map to the same tile at low zooms, so collect the tiles first
+	tiles := map[cachedTileIndexer]bool{}
+	seen := map[cachedCellUpdate]bool{}
+	newest := c.lastScan
+	for _, update := range updates {
+		cellUpdate := cachedCellUpdate{NetworkId: update.NetworkId, GatewayId: update.GatewayId, X: update.X, Y: update.Y, LastUpdated: update.LastUpdated.UnixNano()}
+		seen[cellUpdate] = true
+		if c.seen[cellUpdate] {
+			continue
+		}
+		if update.LastUpdated.After(newest) {
+			newest = update.LastUpdated
+		}
+
+		for z := 0; z <= 19; z++ {
+			xMin, yMin, xMax, yMax := GetAffectedTileRange(update.X, update.Y, z)
+			for x := xMin; x <= xMax; x++ {
+				for y := yMin; y <= yMax; y++ {
+					tiles[cachedTileIndexer{NetworkId: update.NetworkId, GatewayId: update.GatewayId, Z: z, X: x, Y: y}] = true
+				}
+			}
+		}
+	}
+
+	removed := 0
+	for tile := range tiles {
+		removed += removeCachedTile(tile)
+	}
+
+	promTmsCacheInvalidatedCount.Add(float64(removed))
+	c.lastScan = newest
+	c.seen = seen
+	return removed, nil
+}
+
+// Remove all cached variants of the network and gateway versions of a tile in all layers, with their stored versions.
+// Returns the number of tiles removed.
+func removeCachedTile(tile cachedTileIndexer) int {
+	removed := 0
+
+	for _, singleGateway := range []bool{false, true} {
+		tileRequest := TileRequest{
+			NetworkId:     tile.NetworkId,
+			GatewayId:     tile.GatewayId,
+			SingleGateway: singleGateway,
+			Z:             tile.Z,
+			X:             tile.X,
+			Y:             tile.Y,
+		}
+
+		for _, cacheDir := range []string{myConfiguration.CacheDirCircles, myConfiguration.CacheDirBlocks, myConfiguration.CacheDirHeatmap} {
+			tileCacheDir := getTileCacheDir(cacheDir, tileRequest)
+			files, err := os.ReadDir(tileCacheDir)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+
+			err = os.RemoveAll(tileCacheDir)
+			if err != nil {
+				log.Println(err.Error())
+				continue
+			}
+			for _, file := range files {
+				if strings.HasSuffix(file.Name(), ".png") {
+					removed++
+				}
+			}
+		}
+	}
+
+	return removed
+}
+
+// Return the range of tiles at zoom z that include z19 cell x,y, including the tiles its circle reaches into.
+// The max indexes are inclusive.
+func GetAffectedTileRange(x int, y int, z int) (xMin int, yMin int, xMax int, yMax int) {
+	cellsPerTile := math.Pow(2, float64(19-z))
+	buffer := GetCirclesBuffer(z)
+
+	xMin = int(math.Floor(float64(x)/cellsPerTile - buffer))
+	yMin = int(math.Floor(float64(y)/cellsPerTile - buffer))
+	xMax = int(math.Floor(float64(x+1)/cellsPerTile + buffer))
+	yMax = int(math.Floor(float64(y+1)/cellsPerTile + buffer))
+
+	maxIndex := 1<<z - 1
+	return max(xMin, 0), max(yMin, 0), min(xMax, maxIndex), min(yMax, maxIndex)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+	"ttnmapper-tms/types"
+)
+
+func TestCacheInvalidatorScan(t *testing.T) {
+	cacheDirCircles, cacheDirBlocks := myConfiguration.CacheDirCircles, myConfiguration.CacheDirBlocks
+	defer func() {
+		myConfiguration.CacheDirCircles, myConfiguration.CacheDirBlocks = cacheDirCircles, cacheDirBlocks
+	}()
+	myConfiguration.CacheDirCircles = t.TempDir()
+	myConfiguration.CacheDirBlocks = t.TempDir()
+	style := tileStyles["classic"]
+
+	cachedTiles := []struct {
+		tileRequest   TileRequest
+		expectRemoved bool
+	}{
+		// Contains cell 289700,314730 of the test gateway, updated after the last scan
+		{TileRequest{NetworkId: testNetworkId, Z: 14, X: 9053, Y: 9835, Scale: 1}, true},
+		{TileRequest{NetworkId: testNetworkId, Z: 14, X: 9053, Y: 9835, Scale: 2}, true},
+		{TileRequest{NetworkId: testNetworkId, GatewayId: testGatewayId, SingleGateway: true, Z: 14, X: 9053, Y: 9835, Scale: 1}, true},
+		{TileRequest{NetworkId: testNetworkId, Z: 14, X: 9053, Y: 9835, Scale: 1, Source: TileSourcePackets, PacketFilter: PacketFilter{SpreadingFactors: []uint8{7}}}, true},
+		{TileRequest{NetworkId: testNetworkId, Z: 4, X: 8, Y: 9, Scale: 1}, true},
+		// Cell 289615,314735 of the V3 network was updated, the cells of this network in this tile were not
+		{TileRequest{NetworkId: testV3NetworkId, Z: 14, X: 9050, Y: 9835, Scale: 1}, true},
+		{TileRequest{NetworkId: testNetworkId, Z: 14, X: 9050, Y: 9835, Scale: 1}, false},
+		{TileRequest{NetworkId: testNetworkId, Z: 14, X: 9060, Y: 9835, Scale: 1}, false},
+	}
+	for _, cachedTile := range cachedTiles {
+		tileRequest := cachedTile.tileRequest
+		StoreTileInFile(CreateCirclesTile(tileRequest.X, tileRequest.Y, tileRequest.Z, tileRequest.Scale, nil, style), GetCirclesTileFileName(tileRequest, style), TileVersion{})
+	}
+
+	invalidator := NewCacheInvalidator(newTestStore(t), time.Date(2021, 5, 3, 12, 0, 0, 0, time.UTC))
+	removed, err := invalidator.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 6 {
+		t.Errorf("expected 6 tiles removed, got %d", removed)
+	}
+
+	for _, cachedTile := range cachedTiles {
+		_, err := os.Stat(GetCirclesTileFileName(cachedTile.tileRequest, style))
+		if cachedTile.expectRemoved && err == nil {
+			t.Errorf("tile %v should have been removed", cachedTile.tileRequest)
+		}
+		if !cachedTile.expectRemoved && err != nil {
+			t.Errorf("tile %v should have been kept: %s", cachedTile.tileRequest, err.Error())
+		}
+	}
+
+	// Nothing changed since the previous scan
+	removed, err = invalidator.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 {
+		t.Errorf("expected no tiles removed on the second scan, got %d", removed)
+	}
+}
+
+func TestCacheInvalidatorScanLateCommit(t *testing.T) {
+	cacheDirCircles := myConfiguration.CacheDirCircles
+	defer func() { myConfiguration.CacheDirCircles = cacheDirCircles }()
+	myConfiguration.CacheDirCircles = t.TempDir()
+	style := tileStyles["classic"]
+
+	store := newTestStore(t)
+	invalidator := NewCacheInvalidator(store, time.Date(2021, 5, 3, 12, 0, 0, 0, time.UTC))
+	_, err := invalidator.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A cell committed after the scan, but with a LastUpdated from before the newest update the scan saw
+	tileRequest := TileRequest{NetworkId: testNetworkId, Z: 14, X: 9060, Y: 9835, Scale: 1}
+	tileFileName := GetCirclesTileFileName(tileRequest, style)
+	StoreTileInFile(CreateCirclesTile(tileRequest.X, tileRequest.Y, tileRequest.Z, tileRequest.Scale, nil, style), tileFileName, TileVersion{})
+	store.GridCells = append(store.GridCells, types.GridCell{AntennaID: 1, X: 9060*32 + 16, Y: 9835*32 + 16, BucketHigh: 1, LastUpdated: invalidator.lastScan.Add(-time.Minute)})
+
+	removed, err := invalidator.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("expected the tile of the late cell removed, got %d tiles removed", removed)
+	}
+	_, err = os.Stat(tileFileName)
+	if err == nil {
+		t.Error("tile of the late cell should have been removed")
+	}
+
+	// The cells seen before are not removed again by the overlapping scan
+	StoreTileInFile(CreateCirclesTile(tileRequest.X, tileRequest.Y, tileRequest.Z, tileRequest.Scale, nil, style), tileFileName, TileVersion{})
+	removed, err = invalidator.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 {
+		t.Errorf("expected no tiles removed on the next scan, got %d", removed)
+	}
+}
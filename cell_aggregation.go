@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"ttnmapper-tms/types"
+)
+
+// Aggregation modes that pick the bucket a grid cell is drawn with
+const (
+	AggregationModal      = "modal"      // the bucket with the most measurements
+	AggregationBest       = "best"       // the strongest bucket that was heard
+	AggregationWorst      = "worst"      // the weakest bucket that was heard
+	AggregationMean       = "mean"       // the weighted mean of the bucket centres
+	AggregationPercentile = "percentile" // the bucket that the given percentage of measurements reached
+)
+
+// CellAggregation is the way the histogram of a grid cell is reduced to the MaxBucketIndex it is drawn with.
+// The zero value is the modal aggregation.
+type CellAggregation struct {
+	Mode       string
+	Percentile float64
+}
+
+// Return the aggregation selected by the aggregation and percentile query parameters
+func GetRequestAggregation(r *http.Request) (CellAggregation, error) {
+	query := r.URL.Query()
+
+	aggregation := CellAggregation{Mode: query.Get("aggregation")}
+	switch aggregation.Mode {
+	case "", AggregationModal:
+		return CellAggregation{}, nil
+	case AggregationBest, AggregationWorst, AggregationMean:
+		return aggregation, nil
+	case AggregationPercentile:
+		aggregation.Percentile = 90
+		if query.Has("percentile") {
+			percentile, err := strconv.ParseFloat(query.Get("percentile"), 64)
+			if err != nil || math.IsNaN(percentile) || percentile <= 0 || percentile > 100 {
+				return aggregation, errors.New("percentile invalid")
+			}
+			aggregation.Percentile = percentile
+		}
+		return aggregation, nil
+	}
+
+	return aggregation, errors.New("aggregation invalid")
+}
+
+// Name used to tell tiles with different aggregations apart in the disk cache. Empty for the default modal aggregation.
+func (a CellAggregation) Name() string {
+	switch a.Mode {
+	case "", AggregationModal:
+		return ""
+	case AggregationPercentile:
+		return "p" + strconv.FormatFloat(a.Percentile, 'f', -1, 64)
+	}
+	return a.Mode
+}
+
+// Return the bucket index a grid cell is drawn with
+func (a CellAggregation) BucketIndex(gridCell types.GridCell) int {
+	switch a.Mode {
+	case AggregationBest:
+		return getBestBucket(gridCell)
+	case AggregationWorst:
+		return getWorstBucket(gridCell)
+	case AggregationMean:
+		return getMeanBucket(gridCell)
+	case AggregationPercentile:
+		return getPercentileBucket(gridCell, a.Percentile)
+	}
+	return getMaxBucket(gridCell)
+}
+
+// The strongest bucket with measurements, or NoSignal if the cell was never heard
+func getBestBucket(gridCell types.GridCell) int {
+	buckets := gridCellBuckets(gridCell)
+	for i := 0; i < 12; i++ {
+		if buckets[i] > 0 {
+			return i
+		}
+	}
+	return 12
+}
+
+// The weakest bucket with measurements, or NoSignal if the cell was never heard
+func getWorstBucket(gridCell types.GridCell) int {
+	buckets := gridCellBuckets(gridCell)
+	for i := 11; i >= 0; i-- {
+		if buckets[i] > 0 {
+			return i
+		}
+	}
+	return 12
+}
+
+// The bucket containing the mean signal of all heard measurements. The buckets are all 5dB wide,
+// so the weighted mean of the bucket centres is the weighted mean of the bucket indexes.
+func getMeanBucket(gridCell types.GridCell) int {
+	buckets := gridCellBuckets(gridCell)
+
+	var sum, count float64
+	for i := 0; i < 12; i++ {
+		sum += float64(i) * float64(buckets[i])
+		count += float64(buckets[i])
+	}
+	if count == 0 {
+		return 12
+	}
+	return int(math.Round(sum / count))
+}
+
+// The weakest bucket that at least the given percentage of measurements reached. Measurements without signal
+// count as the weakest, so with 90 a cell is only drawn as covered when 90% of the packets were received.
+func getPercentileBucket(gridCell types.GridCell, percentile float64) int {
+	buckets := gridCellBuckets(gridCell)
+
+	var total uint
+	for _, count := range buckets {
+		total += count
+	}
+	if total == 0 {
+		return 12
+	}
+
+	needed := percentile / 100 * float64(total)
+	var cumulative uint
+	for i, count := range buckets {
+		cumulative += count
+		if float64(cumulative) >= needed {
+			return i
+		}
+	}
+	return 12
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"ttnmapper-tms/types"
+)
+
+func TestCellAggregationBucketIndex(t *testing.T) {
+	gridCell := types.GridCell{BucketHigh: 1, Bucket100: 2, Bucket110: 3, BucketNoSignal: 4}
+
+	for _, test := range []struct {
+		aggregation CellAggregation
+		expected    int
+	}{
+		{CellAggregation{}, 12},
+		{CellAggregation{Mode: AggregationBest}, 0},
+		{CellAggregation{Mode: AggregationWorst}, 3},
+		{CellAggregation{Mode: AggregationMean}, 2},
+		{CellAggregation{Mode: AggregationPercentile, Percentile: 50}, 3},
+		{CellAggregation{Mode: AggregationPercentile, Percentile: 90}, 12},
+	} {
+		actual := test.aggregation.BucketIndex(gridCell)
+		if actual != test.expected {
+			t.Errorf("%s %v: expected bucket %d, got %d", test.aggregation.Mode, test.aggregation.Percentile, test.expected, actual)
+		}
+	}
+
+	// A cell that was never heard is NoSignal in every mode
+	for _, mode := range []string{AggregationBest, AggregationWorst, AggregationMean, AggregationPercentile} {
+		actual := CellAggregation{Mode: mode, Percentile: 90}.BucketIndex(types.GridCell{BucketNoSignal: 1})
+		if actual != 12 {
+			t.Errorf("%s: expected bucket 12, got %d", mode, actual)
+		}
+	}
+}
+
+func TestGetTileAggregation(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	for _, test := range []struct {
+		query    string
+		expected int
+	}{
+		{"?aggregation=best", http.StatusOK},
+		{"?aggregation=percentile&percentile=75", http.StatusOK},
+		{"?aggregation=unknown", http.StatusBadRequest},
+		{"?aggregation=percentile&percentile=0", http.StatusBadRequest},
+		{"?aggregation=percentile&percentile=abc", http.StatusBadRequest},
+		{"?aggregation=percentile&percentile=NaN", http.StatusBadRequest},
+	} {
+		for _, layer := range []string{"circles", "blocks"} {
+			resp, err := http.Get(server.URL + "/" + layer + "/network/thethingsnetwork.org/14/9050/9835.png" + test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.expected {
+				t.Errorf("%s%s: expected status %d, got %d", layer, test.query, test.expected, resp.StatusCode)
+			}
+		}
+	}
+}
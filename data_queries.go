@@ -1,12 +1,94 @@
 package main
 
 import (
-	"github.com/patrickmn/go-cache"
-	"strconv"
+	"context"
 	"time"
 	"ttnmapper-tms/types"
 )
 
+// SampleStore is the source of the coverage data that tiles are drawn from.
+// PostgresStore reads from the ttnmapper database, MemoryStore serves fixtures for tests.
+type SampleStore interface {
+	// Return all grid cells of a network between a range of z19 x and y indexes that were last updated in the window,
+	// one per antenna per x,y.
+	GetNetworkGridCellsInRange(networkId string, xMin int, yMin int, xMax int, yMax int, window TimeWindow) ([]types.GridCell, error)
+	// Return all grid cells of a gateway between a range of z19 x and y indexes that were last updated in the window,
+	// one per antenna per x,y.
+	GetGatewayGridCellsInRange(networkId string, gatewayId string, xMin int, yMin int, xMax int, yMax int, window TimeWindow) ([]types.GridCell, error)
+	// Return the packets matching the filter between a range of z19 x and y indexes that were received in the window,
+	// aggregated into grid cells, one per antenna per x,y.
+	GetPacketGridCellsInRange(ctx context.Context, filter PacketFilter, xMin int, yMin int, xMax int, yMax int, window TimeWindow) ([]types.GridCell, error)
+	// Return the newest time of the packets matching the filter between a range of z19 x and y indexes, zero if there are none.
+	GetPacketLastUpdatedInRange(ctx context.Context, filter PacketFilter, xMin int, yMin int, xMax int, yMax int) (time.Time, error)
+	// Return the gateways of a network located inside a bounding box, at their forced location if they have one.
+	// Blacklisted gateways, whose GatewayLocationForce is 0,0, are skipped.
+	GetGatewaysInBoundingBox(networkId string, boundingBox BoundingBox) ([]types.Gateway, error)
+	// Return a gateway at its forced location if it has one, and whether it was found. Blacklisted gateways are not found.
+	GetGateway(networkId string, gatewayId string) (types.Gateway, bool, error)
+	// Return a page of the networks that have gateways, ordered by network ID, optionally only those whose ID starts with a prefix.
+	GetNetworks(query ListQuery) ([]types.NetworkSummary, error)
+	// Return a page of the gateways of a network ordered by gateway ID, like GetGatewaysInBoundingBox, optionally only
+	// those whose ID starts with a prefix or that are inside a bounding box.
+	GetNetworkGateways(networkId string, boundingBox *BoundingBox, query ListQuery) ([]types.GatewaySummary, error)
+	// Return the most recent time a gateway was installed at a new location, zero if it never moved.
+	GetGatewayInstalledAt(networkId string, gatewayId string) (time.Time, error)
+	// Return the forced location of a gateway, and whether it has one.
+	GetGatewayLocationForce(networkId string, gatewayId string) (types.GatewayLocationForce, bool, error)
+	// Return an antenna, to find the gateway it belongs to.
+	GetAntenna(antennaId uint) (types.Antenna, error)
+	// Return the status of many antennas at once, to decide which of them are shown on network tiles.
+	// Unknown antennas are left out.
+	GetAntennaStatuses(antennaIds []uint) (map[uint]types.AntennaStatus, error)
+	// Return the newest LastUpdated of the grid cells of each antenna of a network between a range of z19 x and y indexes.
+	GetNetworkAntennasLastUpdatedInRange(networkId string, xMin int, yMin int, xMax int, yMax int) (map[uint]time.Time, error)
+	// Return the newest LastUpdated of the grid cells of a gateway between a range of z19 x and y indexes, zero if there are none.
+	GetGatewayLastUpdatedInRange(networkId string, gatewayId string, xMin int, yMin int, xMax int, yMax int) (time.Time, error)
+	// Return the cells of every gateway that were updated after a certain time.
+	GetGridCellUpdatesSince(since time.Time) ([]types.GridCellUpdate, error)
+}
+
+// ListQuery selects a page of a list ordered by ID
+type ListQuery struct {
+	// Only the items whose ID starts with this prefix
+	Prefix string
+
+	Offset int
+	Limit  int
+}
+
+// AntennaSelection decides which antennas the coverage of a network is drawn from
+type AntennaSelection struct {
+	// Also draw the antennas of gateways that are offline
+	IncludeOffline bool
+	// Only count the grid cells updated after their gateway was installed at its current location
+	SinceInstall bool
+}
+
+// Return the samples a tile is drawn with between a range of z19 x and y indexes, from the source the tile request selects
+func GetTileSamplesInRange(ctx context.Context, store SampleStore, tileRequest TileRequest, xMin int, yMin int, xMax int, yMax int) ([]types.Sample, error) {
+	switch tileRequest.Source {
+	case TileSourcePackets:
+		// The packets of every network are selected separately, like the grid cells of every network are
+		var samples []types.Sample
+		for _, networkId := range tileRequest.GetNetworkIds() {
+			filter := tileRequest.GetPacketFilter()
+			filter.NetworkId = networkId
+			networkSamples, err := GetPacketSamplesInRange(ctx, store, filter, xMin, yMin, xMax, yMax, tileRequest.Aggregation, tileRequest.Window, tileRequest.AntennaSelection())
+			if err != nil {
+				return nil, err
+			}
+			samples = append(samples, networkSamples...)
+		}
+		return samples, nil
+	case TileSourceExperiment, TileSourceDevice, TileSourceUser:
+		return GetPacketSamplesPerGatewayInRange(ctx, store, tileRequest.GetPacketFilter(), xMin, yMin, xMax, yMax, tileRequest.Aggregation, tileRequest.Window)
+	}
+	if tileRequest.SingleGateway {
+		return GetGatewaySamplesInRange(store, tileRequest.NetworkId, tileRequest.GatewayId, xMin, yMin, xMax, yMax, tileRequest.Aggregation, tileRequest.Window)
+	}
+	return GetNetworkSamplesInRange(store, tileRequest.GetNetworkIds(), xMin, yMin, xMax, yMax, tileRequest.Aggregation, tileRequest.Window, tileRequest.AntennaSelection())
+}
+
 // Return all grid cells from database between a range of z19 x and y indexes
 //func GetGlobalSamplesInRange(xMin int, yMin int, xMax int, yMax int) []types.Sample {
 //	selectStart := time.Now()
@@ -42,38 +124,20 @@ import (
 //	return samples
 //}
 
-// Return all grid cells from database between a range of z19 x and y indexes
-func GetNetworkSamplesInRange(networkId string, xMin int, yMin int, xMax int, yMax int) ([]types.Sample, error) {
+// Return all grid cells from database between a range of z19 x and y indexes, of the antennas the selection includes.
+// The grid cells of several networks are combined as if they were one network.
+func GetNetworkSamplesInRange(store SampleStore, networkIds []string, xMin int, yMin int, xMax int, yMax int, aggregation CellAggregation, window TimeWindow, selection AntennaSelection) ([]types.Sample, error) {
 	selectStart := time.Now()
 
-	var samples []types.Sample
-	var gridCells []types.GridCell
-
-	// Group by x and y and sum all buckets
-	err := db.Table("grid_cells").
-		Select("antenna_id, x, y, sum(bucket_high) as bucket_high, "+
-			"sum(bucket100) as bucket100, sum(bucket105) as bucket105, "+
-			"sum(bucket110) as bucket110, sum(bucket115) as bucket115, "+
-			"sum(bucket120) as bucket120, sum(bucket125) as bucket125, "+
-			"sum(bucket130) as bucket130, sum(bucket135) as bucket135, "+
-			"sum(bucket140) as bucket140, sum(bucket145) as bucket145, "+
-			"sum(bucket_low) as bucket_low, sum(bucket_no_signal) as bucket_no_signal").
-		Joins("left join antennas on antennas.id = grid_cells.antenna_id").
-		Where("antennas.network_id= ?", networkId).
-		Where("x >= ? AND x <= ? AND y >= ? AND y <= ?", xMin, xMax, yMin, yMax).
-		Group("antenna_id, x, y").
-		Find(&gridCells).Error
-
+	gridCells, err := getNetworksGridCellsInRange(store, networkIds, xMin, yMin, xMax, yMax, window)
 	if err != nil {
-		return samples, err
+		return nil, err
 	}
-
-	for _, gridCell := range gridCells {
-		if GetAntennaOnline(gridCell.AntennaID) {
-			sample := types.Sample{X: gridCell.X, Y: gridCell.Y, MaxBucketIndex: getMaxBucket(gridCell)}
-			samples = append(samples, sample)
-		}
+	gridCells, err = visibleGridCells(store, gridCells, selection)
+	if err != nil {
+		return nil, err
 	}
+	samples := gridCellSamples(gridCells, aggregation)
 
 	// Prometheus stats
 	selectElapsed := time.Since(selectStart)
@@ -83,76 +147,264 @@ func GetNetworkSamplesInRange(networkId string, xMin int, yMin int, xMax int, yM
 }
 
 // Samples are group by gateway, so it will sum all antennas
-func GetGatewaySamplesInRange(networkId string, gatewayId string, xMin int, yMin int, xMax int, yMax int) ([]types.Sample, error) {
+func GetGatewaySamplesInRange(store SampleStore, networkId string, gatewayId string, xMin int, yMin int, xMax int, yMax int, aggregation CellAggregation, window TimeWindow) ([]types.Sample, error) {
 	selectStart := time.Now()
 
+	blacklisted, err := GetGatewayBlacklisted(store, networkId, gatewayId)
+	if err != nil || blacklisted {
+		return nil, err
+	}
+
+	gridCells, err := store.GetGatewayGridCellsInRange(networkId, gatewayId, xMin, yMin, xMax, yMax, window)
+	if err != nil {
+		return nil, err
+	}
+	samples := mergedSamples(gridCells, aggregation)
+
+	// Prometheus stats
+	selectElapsed := time.Since(selectStart)
+	promTmsGatewaySelectDuration.Observe(float64(selectElapsed.Nanoseconds()) / 1000.0 / 1000.0) //nanoseconds to milliseconds
+
+	return samples, nil
+}
+
+// Aggregate the packets matching a filter into samples. Like grid cells, the antennas of a single gateway are summed,
+// while a network has a sample per antenna the selection includes.
+func GetPacketSamplesInRange(ctx context.Context, store SampleStore, filter PacketFilter, xMin int, yMin int, xMax int, yMax int, aggregation CellAggregation, window TimeWindow, selection AntennaSelection) ([]types.Sample, error) {
+	if filter.GatewayId != "" {
+		blacklisted, err := GetGatewayBlacklisted(store, filter.NetworkId, filter.GatewayId)
+		if err != nil || blacklisted {
+			return nil, err
+		}
+	}
+
+	gridCells, err := store.GetPacketGridCellsInRange(ctx, filter, xMin, yMin, xMax, yMax, window)
+	if err != nil {
+		return nil, err
+	}
+
+	if filter.GatewayId != "" {
+		return mergedSamples(gridCells, aggregation), nil
+	}
+	gridCells, err = visibleGridCells(store, gridCells, selection)
+	if err != nil {
+		return nil, err
+	}
+	return gridCellSamples(gridCells, aggregation), nil
+}
+
+// Aggregate the packets of an experiment, device or user into one sample per gateway per x,y. These measurements are
+// historic, so unlike the coverage map the gateways that are offline by now are included. Blacklisted gateways are not.
+func GetPacketSamplesPerGatewayInRange(ctx context.Context, store SampleStore, filter PacketFilter, xMin int, yMin int, xMax int, yMax int, aggregation CellAggregation, window TimeWindow) ([]types.Sample, error) {
+	gridCells, err := store.GetPacketGridCellsInRange(ctx, filter, xMin, yMin, xMax, yMax, window)
+	if err != nil {
+		return nil, err
+	}
+
+	gatewayCells, err := mergeGridCellsPerGateway(store, gridCells)
+	if err != nil {
+		return nil, err
+	}
+
 	var samples []types.Sample
+	for _, gridCell := range gatewayCells {
+		sample := types.Sample{X: gridCell.X, Y: gridCell.Y, MaxBucketIndex: aggregation.BucketIndex(gridCell)}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// One sample per grid cell
+func gridCellSamples(gridCells []types.GridCell, aggregation CellAggregation) []types.Sample {
+	var samples []types.Sample
+	for _, gridCell := range gridCells {
+		sample := types.Sample{X: gridCell.X, Y: gridCell.Y, MaxBucketIndex: aggregation.BucketIndex(gridCell)}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// One sample per x,y, with the grid cells of all antennas summed
+func mergedSamples(gridCells []types.GridCell, aggregation CellAggregation) []types.Sample {
+	var samples []types.Sample
+	for _, mergedCell := range mergeGridCells(gridCells) {
+		sample := types.Sample{X: mergedCell.X, Y: mergedCell.Y, MaxBucketIndex: aggregation.BucketIndex(mergedCell.GridCell)}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// Return one cell per x,y with the buckets of the antennas of one or more networks the selection includes summed,
+// skipping blacklisted gateways
+func GetNetworkMergedCellsInRange(store SampleStore, networkIds []string, xMin int, yMin int, xMax int, yMax int, window TimeWindow, selection AntennaSelection) ([]types.MergedGridCell, error) {
+	gridCells, err := getNetworksGridCellsInRange(store, networkIds, xMin, yMin, xMax, yMax, window)
+	if err != nil {
+		return nil, err
+	}
+
+	gridCells, err = visibleGridCells(store, gridCells, selection)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeGridCells(gridCells), nil
+}
+
+// Return the grid cells of several networks together
+func getNetworksGridCellsInRange(store SampleStore, networkIds []string, xMin int, yMin int, xMax int, yMax int, window TimeWindow) ([]types.GridCell, error) {
 	var gridCells []types.GridCell
+	for _, networkId := range networkIds {
+		networkCells, err := store.GetNetworkGridCellsInRange(networkId, xMin, yMin, xMax, yMax, window)
+		if err != nil {
+			return nil, err
+		}
+		gridCells = append(gridCells, networkCells...)
+	}
+	return gridCells, nil
+}
 
-	// Group by x and y and sum all buckets
-	err := db.Table("grid_cells").
-		Select("x, y, sum(bucket_high) as bucket_high, "+
-			"sum(bucket100) as bucket100, sum(bucket105) as bucket105, "+
-			"sum(bucket110) as bucket110, sum(bucket115) as bucket115, "+
-			"sum(bucket120) as bucket120, sum(bucket125) as bucket125, "+
-			"sum(bucket130) as bucket130, sum(bucket135) as bucket135, "+
-			"sum(bucket140) as bucket140, sum(bucket145) as bucket145, "+
-			"sum(bucket_low) as bucket_low, sum(bucket_no_signal) as bucket_no_signal").
-		Joins("left join antennas on antennas.id = grid_cells.antenna_id").
-		Where("antennas.network_id= ?", networkId).
-		Where("antennas.gateway_id = ?", gatewayId).
-		Where("x >= ? AND x <= ? AND y >= ? AND y <= ?", xMin, xMax, yMin, yMax).
-		Group("x, y").
-		Find(&gridCells).Error
+// Return one cell per x,y with the buckets of all antennas of a gateway summed, none if the gateway is blacklisted
+func GetGatewayMergedCellsInRange(store SampleStore, networkId string, gatewayId string, xMin int, yMin int, xMax int, yMax int, window TimeWindow) ([]types.MergedGridCell, error) {
+	blacklisted, err := GetGatewayBlacklisted(store, networkId, gatewayId)
+	if err != nil || blacklisted {
+		return nil, err
+	}
 
+	gridCells, err := store.GetGatewayGridCellsInRange(networkId, gatewayId, xMin, yMin, xMax, yMax, window)
 	if err != nil {
-		return samples, err
+		return nil, err
 	}
 
+	return mergeGridCells(gridCells), nil
+}
+
+// Network coverage is only shown for antennas of gateways that are online, or all gateways if the selection includes
+// offline gateways, and that are not blacklisted. The status of all antennas of the grid cells is looked up at once.
+func visibleGridCells(store SampleStore, gridCells []types.GridCell, selection AntennaSelection) ([]types.GridCell, error) {
+	antennaIds := make([]uint, 0, len(gridCells))
+	seen := map[uint]bool{}
 	for _, gridCell := range gridCells {
-		sample := types.Sample{X: gridCell.X, Y: gridCell.Y, MaxBucketIndex: getMaxBucket(gridCell)}
-		samples = append(samples, sample)
+		if !seen[gridCell.AntennaID] {
+			seen[gridCell.AntennaID] = true
+			antennaIds = append(antennaIds, gridCell.AntennaID)
+		}
 	}
 
-	// Prometheus stats
-	selectElapsed := time.Since(selectStart)
-	promTmsGatewaySelectDuration.Observe(float64(selectElapsed.Nanoseconds()) / 1000.0 / 1000.0) //nanoseconds to milliseconds
+	statuses, err := store.GetAntennaStatuses(antennaIds)
+	if err != nil {
+		return nil, err
+	}
 
-	return samples, nil
+	var visible []types.GridCell
+	for _, gridCell := range gridCells {
+		status, ok := statuses[gridCell.AntennaID]
+		if !ok || !antennaVisible(status, selection) {
+			continue
+		}
+		if selection.SinceInstall && gridCell.LastUpdated.Before(status.InstalledAt) {
+			continue
+		}
+		visible = append(visible, gridCell)
+	}
+	return visible, nil
 }
 
-func GetAntennaOnline(antennaId uint) bool {
+// Check if the coverage of an antenna is shown on network tiles, regardless of the age of its grid cells
+func antennaVisible(status types.AntennaStatus, selection AntennaSelection) bool {
+	return !status.Blacklisted && (selection.IncludeOffline || LastHeardOnline(status.LastHeard))
+}
+
+// A gateway is blacklisted by forcing its location to 0,0
+func GetGatewayBlacklisted(store SampleStore, networkId string, gatewayId string) (bool, error) {
+	force, ok, err := store.GetGatewayLocationForce(networkId, gatewayId)
+	if err != nil {
+		return false, err
+	}
+	return ok && force.Latitude == 0 && force.Longitude == 0, nil
+}
+
+// A gateway is online if it was heard within the configured threshold, five days by default
+func LastHeardOnline(lastHeard time.Time) bool {
+	threshold := time.Now().Add(-time.Duration(myConfiguration.GatewayOfflineHours) * time.Hour)
+	return !lastHeard.Before(threshold)
+}
 
-	fiveDaysAgo := time.Now().AddDate(0, 0, -5)
+// Sum grid cells with the same x,y, keeping the order in which they first appear
+func mergeGridCells(gridCells []types.GridCell) []types.MergedGridCell {
+	var mergedCells []types.MergedGridCell
+	cellIndexes := map[types.GridCellIndexer]int{}
 
-	if lastHeardTime, ok := antennaLastHeardCache.Get(strconv.Itoa(int(antennaId))); ok {
-		//log.Println("Antenna last heard from cache")
-		if lastHeardTime.(time.Time).Before(fiveDaysAgo) {
-			return false
-		} else {
-			return true
+	for _, gridCell := range gridCells {
+		indexer := types.GridCellIndexer{X: gridCell.X, Y: gridCell.Y}
+		i, ok := cellIndexes[indexer]
+		if !ok {
+			i = len(mergedCells)
+			cellIndexes[indexer] = i
+			mergedCells = append(mergedCells, types.MergedGridCell{GridCell: types.GridCell{X: gridCell.X, Y: gridCell.Y}})
 		}
+		addGridCellBuckets(&mergedCells[i].GridCell, gridCell)
+		mergedCells[i].AntennaCount++
 	}
-	//log.Println("Antenna last heard from db")
 
-	type Result struct {
-		LastHeard time.Time
+	return mergedCells
+}
+
+// Sum the grid cells of the antennas of the same gateway at the same x,y, keeping the order in which they first appear.
+// The merged cells keep the AntennaID of the first antenna. The cells of blacklisted gateways are skipped.
+func mergeGridCellsPerGateway(store SampleStore, gridCells []types.GridCell) ([]types.GridCell, error) {
+	type gatewayCellIndexer struct {
+		types.GatewayIndexer
+		X int
+		Y int
+	}
+
+	var mergedCells []types.GridCell
+	cellIndexes := map[gatewayCellIndexer]int{}
+
+	for _, gridCell := range gridCells {
+		antenna, err := store.GetAntenna(gridCell.AntennaID)
+		if err != nil {
+			return nil, err
+		}
+
+		blacklisted, err := GetGatewayBlacklisted(store, antenna.NetworkId, antenna.GatewayId)
+		if err != nil {
+			return nil, err
+		}
+		if blacklisted {
+			continue
+		}
+
+		indexer := gatewayCellIndexer{types.GatewayIndexer{NetworkId: antenna.NetworkId, GatewayId: antenna.GatewayId}, gridCell.X, gridCell.Y}
+		i, ok := cellIndexes[indexer]
+		if !ok {
+			i = len(mergedCells)
+			cellIndexes[indexer] = i
+			mergedCells = append(mergedCells, types.GridCell{AntennaID: gridCell.AntennaID, X: gridCell.X, Y: gridCell.Y})
+		}
+		addGridCellBuckets(&mergedCells[i], gridCell)
 	}
 
-	var result Result
-	db.Table("antennas").
-		Select("last_heard").
-		Joins("JOIN gateways g on antennas.gateway_id = g.gateway_id and antennas.network_id = g.network_id").
-		Where("antennas.id= ?", antennaId).
-		Scan(&result)
+	return mergedCells, nil
+}
 
-	// Store in cache
-	antennaLastHeardCache.Set(strconv.Itoa(int(antennaId)), result.LastHeard, cache.DefaultExpiration)
-	promAntennaCacheItemCount.Set(float64(antennaLastHeardCache.ItemCount()))
+// Add the bucket counts of src to dst
+func addGridCellBuckets(dst *types.GridCell, src types.GridCell) {
+	dst.BucketHigh += src.BucketHigh
+	dst.Bucket100 += src.Bucket100
+	dst.Bucket105 += src.Bucket105
+	dst.Bucket110 += src.Bucket110
+	dst.Bucket115 += src.Bucket115
+	dst.Bucket120 += src.Bucket120
+	dst.Bucket125 += src.Bucket125
+	dst.Bucket130 += src.Bucket130
+	dst.Bucket135 += src.Bucket135
+	dst.Bucket140 += src.Bucket140
+	dst.Bucket145 += src.Bucket145
+	dst.BucketLow += src.BucketLow
+	dst.BucketNoSignal += src.BucketNoSignal
 
-	if result.LastHeard.Before(fiveDaysAgo) {
-		return false
-	} else {
-		return true
+	if src.LastUpdated.After(dst.LastUpdated) {
+		dst.LastUpdated = src.LastUpdated
 	}
 }
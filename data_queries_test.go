@@ -1,72 +1,234 @@
 package main
 
 import (
-	"github.com/patrickmn/go-cache"
-	"github.com/tkanos/gonfig"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
-	"log"
-	"os"
-	"path/filepath"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
 
-func initDb() {
-	err := gonfig.GetConf("conf.json", &myConfiguration)
+const (
+	testNetworkId        = "thethingsnetwork.org"
+	testGatewayId        = "eui-60c5a8fffe761551"
+	testOfflineGateway   = "eui-00000000000000ff"
+	testBlacklistGateway = "eui-00000000000000bb" // GatewayLocationForce at 0,0
+	testV3NetworkId      = "NS_TTS_V3://ttn@000013"
+	testTileX, testTileY = 9050, 9835 // https://tile.openstreetmap.org/14/9050/9835.png - Stellebosch Central
+	testTileZ            = 14
+)
+
+// Load the fixtures in testdata/store.json. Fixtures are static, so all gateways except the
+// offline one are marked as heard just now.
+func newTestStore(t *testing.T) *MemoryStore {
+	store, err := LoadMemoryStore("testdata/store.json")
 	if err != nil {
-		log.Println(err)
+		t.Fatal(err)
 	}
 
-	log.Printf("[Configuration]\n%s\n", prettyPrint(myConfiguration)) // output: [UserA, UserB]
+	for i := range store.Gateways {
+		if store.Gateways[i].GatewayId != testOfflineGateway {
+			store.Gateways[i].LastHeard = time.Now()
+		}
+	}
+
+	return store
+}
 
-	var gormLogLevel = logger.Silent
-	if myConfiguration.PostgresDebugLog {
-		log.Println("Database debug logging enabled")
-		gormLogLevel = logger.Info
+// Request a path from the test server and decode the body of the response, which should be 200 OK. Tiles are
+// decoded with png.Decode and API responses with decodeTestJson.
+func getTestResponse[T any](t *testing.T, server *httptest.Server, path string, decode func(io.Reader) (T, error)) T {
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: unexpected status %d", path, resp.StatusCode)
 	}
 
-	dsn := "host=" + myConfiguration.PostgresHost + " port=" + myConfiguration.PostgresPort + " user=" + myConfiguration.PostgresUser +
-		" dbname=" + myConfiguration.PostgresDatabase + " password=" + myConfiguration.PostgresPassword + " sslmode=disable" +
-		" application_name=" + filepath.Base(os.Args[0])
-	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{
-		Logger: logger.Default.LogMode(gormLogLevel),
-	})
+	response, err := decode(resp.Body)
 	if err != nil {
-		panic(err.Error())
+		t.Fatal(err)
 	}
+	return response
+}
+
+func decodeTestJson[T any](body io.Reader) (T, error) {
+	var response T
+	err := json.NewDecoder(body).Decode(&response)
+	return response, err
 }
 
 func TestGetNetworkSamplesInRange(t *testing.T) {
-	initDb()
-
-	// https://tile.openstreetmap.org/14/9050/9835.png - Stellebosch Central
-	// https://stamen-tiles-d.a.ssl.fastly.net/toner-lite/12/2170/1345.png - wolfsburg central
-	xMin, yMin, xMax, yMax := GetZ19TileRangeBuffer(2170, 1345, 12, 0)
-	//networkId := "thethingsnetwork.org"
-	networkId := "NS_CHIRP://wolfsburg.digital"
-	//networkId := "NS_TTS_V3://ttn@000013"
-	data := GetNetworkSamplesInRange(networkId, xMin, yMin, xMax, yMax)
-	log.Println(data)
+	store := newTestStore(t)
+
+	xMin, yMin, xMax, yMax := GetZ19TileRangeBuffer(testTileX, testTileY, testTileZ, 0)
+	samples, err := GetNetworkSamplesInRange(store, []string{testNetworkId}, xMin, yMin, xMax, yMax, CellAggregation{}, TimeWindow{}, AntennaSelection{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One sample per online antenna per cell. The offline gateway and the cell outside the tile are skipped.
+	if len(samples) != 3 {
+		t.Fatalf("expected 3 samples, got %d: %v", len(samples), samples)
+	}
+	for _, sample := range samples {
+		if sample.X == 289612 {
+			t.Errorf("sample of offline gateway returned: %v", sample)
+		}
+	}
+}
+
+func TestGetNetworkSamplesInRangeTimeWindow(t *testing.T) {
+	store := newTestStore(t)
+
+	xMin, yMin, xMax, yMax := GetZ19TileRangeBuffer(testTileX, testTileY, testTileZ, 0)
+	for _, test := range []struct {
+		window   TimeWindow
+		expected int
+	}{
+		{TimeWindow{Since: time.Date(2021, 5, 2, 8, 0, 0, 0, time.UTC)}, 2},
+		{TimeWindow{Until: time.Date(2021, 5, 2, 8, 0, 0, 0, time.UTC)}, 1},
+		{TimeWindow{Since: time.Date(2021, 5, 2, 0, 0, 0, 0, time.UTC), Until: time.Date(2021, 5, 3, 0, 0, 0, 0, time.UTC)}, 1},
+		{TimeWindow{Since: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}, 0},
+	} {
+		samples, err := GetNetworkSamplesInRange(store, []string{testNetworkId}, xMin, yMin, xMax, yMax, CellAggregation{}, test.window, AntennaSelection{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(samples) != test.expected {
+			t.Errorf("%s: expected %d samples, got %d: %v", test.window.Name(), test.expected, len(samples), samples)
+		}
+	}
 }
 
 func TestGetGatewaySamplesInRange(t *testing.T) {
-	initDb()
-
-	// https://tile.openstreetmap.org/14/9050/9835.png - Stellebosch Central
-	xMin, yMin, xMax, yMax := GetZ19TileRangeBuffer(9050, 9835, 14, 0)
-	gatewayId := "eui-60c5a8fffe761551"
-	networkId := "thethingsnetwork.org"
-	//networkId := "NS_TTS_V3://ttn@000013"
-	data := GetGatewaySamplesInRange(networkId, gatewayId, xMin, yMin, xMax, yMax)
-	log.Println(data)
+	store := newTestStore(t)
+
+	xMin, yMin, xMax, yMax := GetZ19TileRangeBuffer(testTileX, testTileY, testTileZ, 0)
+	samples, err := GetGatewaySamplesInRange(store, testNetworkId, testGatewayId, xMin, yMin, xMax, yMax, CellAggregation{}, TimeWindow{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both antennas of the gateway are summed into one sample per cell
+	if len(samples) != 2 {
+		t.Fatalf("expected 2 samples, got %d: %v", len(samples), samples)
+	}
+	for _, sample := range samples {
+		if sample.X == 289610 && sample.MaxBucketIndex != 0 {
+			t.Errorf("expected bucket 0 for summed antennas, got %d", sample.MaxBucketIndex)
+		}
+		if sample.X == 289620 && sample.MaxBucketIndex != 2 {
+			t.Errorf("expected bucket 2, got %d", sample.MaxBucketIndex)
+		}
+	}
+}
+
+func TestGetNetworkSamplesInRangeIncludeOffline(t *testing.T) {
+	store := newTestStore(t)
+
+	xMin, yMin, xMax, yMax := GetZ19TileRangeBuffer(testTileX, testTileY, testTileZ, 0)
+	samples, err := GetNetworkSamplesInRange(store, []string{testNetworkId}, xMin, yMin, xMax, yMax, CellAggregation{}, TimeWindow{}, AntennaSelection{IncludeOffline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The offline gateway is included, the blacklisted one is not
+	if len(samples) != 4 {
+		t.Fatalf("expected 4 samples, got %d: %v", len(samples), samples)
+	}
+}
+
+func TestGetNetworkMergedCellsInRangeNetworks(t *testing.T) {
+	store := newTestStore(t)
+
+	xMin, yMin, xMax, yMax := GetZ19TileRangeBuffer(testTileX, testTileY, testTileZ, 0)
+	cells, err := GetNetworkMergedCellsInRange(store, []string{testNetworkId, testV3NetworkId}, xMin, yMin, xMax, yMax, TimeWindow{}, AntennaSelection{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two cells of the first network and one of the second
+	if len(cells) != 3 {
+		t.Fatalf("expected 3 cells, got %d: %v", len(cells), cells)
+	}
+}
+
+func TestGetAntennaStatuses(t *testing.T) {
+	store := newTestStore(t)
+
+	statuses, err := store.GetAntennaStatuses([]uint{1, 3, 5, 1200})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown antennas are left out
+	if len(statuses) != 3 {
+		t.Fatalf("expected 3 statuses, got %v", statuses)
+	}
+	if !LastHeardOnline(statuses[1].LastHeard) || statuses[1].Blacklisted {
+		t.Errorf("antenna 1 should be online and not blacklisted: %v", statuses[1])
+	}
+	if LastHeardOnline(statuses[3].LastHeard) {
+		t.Errorf("antenna 3 should be offline: %v", statuses[3])
+	}
+	if !statuses[5].Blacklisted {
+		t.Errorf("antenna 5 should be blacklisted: %v", statuses[5])
+	}
+}
+
+func TestLastHeardOnlineThreshold(t *testing.T) {
+	offlineHours := myConfiguration.GatewayOfflineHours
+	defer func() { myConfiguration.GatewayOfflineHours = offlineHours }()
+
+	lastHeard := time.Now().Add(-48 * time.Hour)
+	if !LastHeardOnline(lastHeard) {
+		t.Error("gateway heard two days ago should be online with the default threshold")
+	}
+
+	myConfiguration.GatewayOfflineHours = 24
+	if LastHeardOnline(lastHeard) {
+		t.Error("gateway heard two days ago should be offline with a one day threshold")
+	}
 }
 
-func TestGetAntennaOnline(t *testing.T) {
-	initDb()
-	antennaLastHeardCache = cache.New(1*time.Hour, 2*time.Hour)
+func TestGetGatewayBlacklisted(t *testing.T) {
+	store := newTestStore(t)
+
+	xMin, yMin, xMax, yMax := GetZ19TileRangeBuffer(testTileX, testTileY, testTileZ, 0)
+	samples, err := GetGatewaySamplesInRange(store, testNetworkId, testBlacklistGateway, xMin, yMin, xMax, yMax, CellAggregation{}, TimeWindow{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 0 {
+		t.Errorf("expected no samples for blacklisted gateway, got %v", samples)
+	}
 
-	log.Println(GetAntennaOnline(1200))
-	log.Println(GetAntennaOnline(1200))
+	// The gateway is online, but its antenna is left out of network tiles, even with the offline gateways
+	statuses, err := store.GetAntennaStatuses([]uint{5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !LastHeardOnline(statuses[5].LastHeard) || !statuses[5].Blacklisted {
+		t.Errorf("antenna 5 should be online and blacklisted, got %v", statuses[5])
+	}
+	cells, err := GetNetworkMergedCellsInRange(store, []string{testNetworkId}, xMin, yMin, xMax, yMax, TimeWindow{}, AntennaSelection{IncludeOffline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cell := range cells {
+		if cell.X == 289630 {
+			t.Errorf("cell of blacklisted gateway returned: %v", cell)
+		}
+	}
+
+	// A forced location other than 0,0 only moves a gateway
+	blacklisted, err := GetGatewayBlacklisted(store, testNetworkId, testOfflineGateway)
+	if err != nil || blacklisted {
+		t.Errorf("gateway with forced location should not be blacklisted: %v", err)
+	}
 }
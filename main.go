@@ -10,7 +10,6 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/patrickmn/go-cache"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/tkanos/gonfig"
@@ -26,9 +25,18 @@ Technopark https://tile.openstreetmap.org/15/18098/19674.png
 type Configuration struct {
 	CacheDirCircles string `env:"CACHE_DIR_CIRCLES"`
 	CacheDirBlocks  string `env:"CACHE_DIR_BLOCKS"`
+	CacheDirHeatmap string `env:"CACHE_DIR_HEATMAP"`
 
 	CacheEnabled bool `env:"CACHE_ENABLED"`
 
+	// Seconds between scans for updated grid cells to remove from the cache, 0 to only expire tiles by age
+	CacheInvalidationInterval int `env:"CACHE_INVALIDATION_INTERVAL"`
+
+	DefaultStyle string `env:"DEFAULT_STYLE"`
+
+	// Hours since a gateway was last heard after which its coverage is left out of network tiles
+	GatewayOfflineHours int `env:"GATEWAY_OFFLINE_HOURS"`
+
 	PostgresHost     string `env:"POSTGRES_HOST"`
 	PostgresPort     string `env:"POSTGRES_PORT"`
 	PostgresUser     string `env:"POSTGRES_USER"`
@@ -37,14 +45,26 @@ type Configuration struct {
 	PostgresDebugLog bool   `env:"POSTGRES_DEBUG_LOG"`
 
 	ListenAddress string `env:"LISTEN_ADDRESS"`
+
+	// Base URL the server is reached on by clients, used for the links in WMS capabilities
+	PublicUrl string `env:"PUBLIC_URL"`
+
+	GeoJsonMaxCells int `env:"GEOJSON_MAX_CELLS"`
 }
 
 var myConfiguration = Configuration{
 	CacheDirCircles: "./tile_cache/global_circles",
 	CacheDirBlocks:  "./tile_cache/global_blocks",
+	CacheDirHeatmap: "./tile_cache/global_heatmap",
 
 	CacheEnabled: false,
 
+	CacheInvalidationInterval: 300,
+
+	DefaultStyle: "classic",
+
+	GatewayOfflineHours: 120,
+
 	PostgresHost:     "localhost",
 	PostgresPort:     "5432",
 	PostgresUser:     "username",
@@ -53,6 +73,10 @@ var myConfiguration = Configuration{
 	PostgresDebugLog: false,
 
 	ListenAddress: ":8080",
+
+	PublicUrl: "http://localhost:8080",
+
+	GeoJsonMaxCells: 100000,
 }
 
 var (
@@ -94,9 +118,19 @@ var (
 	//	Buckets: []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1, 1.5, 2, 5, 10, 100, 1000, 10000},
 	//})
 
-	promAntennaCacheItemCount = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "ttnmapper_tms_antenna_cache_size",
-		Help: "Size of the memory cache that holds antennas previously read from the database",
+	promAntennaStatusCacheItemCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ttnmapper_tms_antenna_status_cache_size",
+		Help: "Size of the memory cache that holds the gateway status of antennas previously read from the database",
+	})
+
+	promTmsCacheInvalidatedCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ttnmapper_tms_cache_invalidated_count",
+		Help: "The number of cached tiles removed because their grid cells were updated",
+	})
+
+	promTmsRenderDeduplicatedCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ttnmapper_tms_render_deduplicated_count",
+		Help: "The number of tile requests that waited for the render of an identical concurrent request",
 	})
 
 	promTmsGlobalSelectDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
@@ -109,12 +143,21 @@ var (
 		Help:    "Duration of selecting gateway data for one tile from the database",
 		Buckets: []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1, 1.5, 2, 5, 10, 100, 1000, 10000},
 	})
+)
 
-	// Other global vars
-	db *gorm.DB
+// TileServer holds the dependencies shared by the http handlers
+type TileServer struct {
+	store SampleStore
 
-	antennaLastHeardCache *cache.Cache
-)
+	renderCoalescer *RenderCoalescer
+}
+
+func NewTileServer(store SampleStore) *TileServer {
+	return &TileServer{
+		store:           store,
+		renderCoalescer: NewRenderCoalescer(),
+	}
+}
 
 func prometheusMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -148,7 +191,7 @@ func main() {
 	dsn := "host=" + myConfiguration.PostgresHost + " port=" + myConfiguration.PostgresPort + " user=" + myConfiguration.PostgresUser +
 		" dbname=" + myConfiguration.PostgresDatabase + " password=" + myConfiguration.PostgresPassword + " sslmode=disable" +
 		" application_name=" + filepath.Base(os.Args[0])
-	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
 		Logger: logger.Default.LogMode(gormLogLevel),
 	})
 	if err != nil {
@@ -164,32 +207,83 @@ func main() {
 	// SetConnMaxLifetime sets the maximum amount of time a connection may be reused.
 	sqlDB.SetConnMaxLifetime(10 * time.Minute)
 
-	// Cache
-	antennaLastHeardCache = cache.New(5*time.Minute, 1*time.Minute)
+	server := NewTileServer(NewPostgresStore(db))
+
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "seed" {
+		err = RunSeed(server, os.Args[2:])
+		failOnError(err, "Seeding failed")
+		return
+	}
 
 	// Register prometheus stats
-	prometheus.MustRegister(promAntennaCacheItemCount)
+	prometheus.MustRegister(promAntennaStatusCacheItemCount)
 	prometheus.MustRegister(promTmsRequestDuration)
 	prometheus.MustRegister(promTmsGlobalSelectDuration)
 	prometheus.MustRegister(promTmsGatewaySelectDuration)
+	prometheus.MustRegister(promTmsCacheInvalidatedCount)
+	prometheus.MustRegister(promTmsRenderDeduplicatedCount)
+
+	if myConfiguration.CacheEnabled && myConfiguration.CacheInvalidationInterval > 0 {
+		// Also pick up cells updated while the server was restarting
+		invalidator := NewCacheInvalidator(server.store, time.Now().Add(-1*time.Hour))
+		go invalidator.Run(time.Duration(myConfiguration.CacheInvalidationInterval) * time.Second)
+	}
 
 	log.Println("Starting server")
-	router := mux.NewRouter().UseEncodedPath() //.StrictSlash(true)
-	router.Use(loggingMiddleware)
-	router.Use(prometheusMiddleware)
-	router.HandleFunc("/", Index)
+	router := server.NewRouter()
 	router.Handle("/metrics", promhttp.Handler())
 	router.PathPrefix("/debug/pprof/").Handler(http.DefaultServeMux)
 
-	// Tile endpoints
-	router.HandleFunc("/circles/network/{network_id}/{z}/{x}/{y}", GetCirclesTile)
-	router.HandleFunc("/blocks/network/{network_id}/{z}/{x}/{y}", GetBlocksTile)
-	router.HandleFunc("/circles/gateway/{network_id}/{gateway_id}/{z}/{x}/{y}", GetCirclesTile)
-	router.HandleFunc("/blocks/gateway/{network_id}/{gateway_id}/{z}/{x}/{y}", GetBlocksTile)
+	// The timeout handler buffers the whole response, so streamed responses get a write deadline instead
+	rootMux := http.NewServeMux()
+	rootMux.Handle("/api/cells.geojson", writeDeadlineHandler(router, time.Minute*1))
+	rootMux.Handle("/", http.TimeoutHandler(router, time.Minute*1, "Handler Timeout!"))
+	log.Fatal(http.ListenAndServe(myConfiguration.ListenAddress, rootMux))
 
-	routerWithTimeout := http.TimeoutHandler(router, time.Minute*1, "Handler Timeout!")
-	log.Fatal(http.ListenAndServe(myConfiguration.ListenAddress, routerWithTimeout))
+}
 
+func (s *TileServer) NewRouter() *mux.Router {
+	router := mux.NewRouter().UseEncodedPath() //.StrictSlash(true)
+	router.Use(loggingMiddleware)
+	router.Use(prometheusMiddleware)
+	router.HandleFunc("/", Index)
+
+	// Tile endpoints. The raster tiles are also served at 512px when {y} is requested as {y}@2x.png
+	router.HandleFunc("/circles/network/{network_id}/{z}/{x}/{y}", s.GetCirclesTile)
+	router.HandleFunc("/blocks/network/{network_id}/{z}/{x}/{y}", s.GetBlocksTile)
+	router.HandleFunc("/circles/gateway/{network_id}/{gateway_id}/{z}/{x}/{y}", s.GetCirclesTile)
+	router.HandleFunc("/blocks/gateway/{network_id}/{gateway_id}/{z}/{x}/{y}", s.GetBlocksTile)
+	router.HandleFunc("/circles/{source:packets}/network/{network_id}/{z}/{x}/{y}", s.GetCirclesTile)
+	router.HandleFunc("/blocks/{source:packets}/network/{network_id}/{z}/{x}/{y}", s.GetBlocksTile)
+	router.HandleFunc("/circles/{source:packets}/gateway/{network_id}/{gateway_id}/{z}/{x}/{y}", s.GetCirclesTile)
+	router.HandleFunc("/blocks/{source:packets}/gateway/{network_id}/{gateway_id}/{z}/{x}/{y}", s.GetBlocksTile)
+	router.HandleFunc("/circles/{source:experiment}/{experiment}/{z}/{x}/{y}", s.GetCirclesTile)
+	router.HandleFunc("/blocks/{source:experiment}/{experiment}/{z}/{x}/{y}", s.GetBlocksTile)
+	router.HandleFunc("/circles/{source:device}/{app_id}/{dev_id}/{z}/{x}/{y}", s.GetCirclesTile)
+	router.HandleFunc("/blocks/{source:device}/{app_id}/{dev_id}/{z}/{x}/{y}", s.GetBlocksTile)
+	router.HandleFunc("/circles/{source:user}/{user}/{z}/{x}/{y}", s.GetCirclesTile)
+	router.HandleFunc("/blocks/{source:user}/{user}/{z}/{x}/{y}", s.GetBlocksTile)
+	router.HandleFunc("/gateways/network/{network_id}/{z}/{x}/{y}", s.GetGatewaysTile)
+	router.HandleFunc("/heatmap/legend.png", GetHeatmapLegend)
+	router.HandleFunc("/heatmap/network/{network_id}/{z}/{x}/{y}", s.GetHeatmapTile)
+	router.HandleFunc("/mvt/network/{network_id}/{z}/{x}/{y}.pbf", s.GetMvtTile)
+	router.HandleFunc("/mvt/gateway/{network_id}/{gateway_id}/{z}/{x}/{y}.pbf", s.GetMvtTile)
+
+	// Data endpoints
+	router.HandleFunc("/api/cells.geojson", s.GetCellsGeoJson)
+	router.HandleFunc("/api/gateways.geojson", s.GetGatewaysGeoJson)
+	router.HandleFunc("/api/networks", s.GetNetworks)
+	router.HandleFunc("/api/networks/{network_id}/gateways", s.GetNetworkGateways)
+	router.HandleFunc("/api/gateway/{network_id}/{gateway_id}/stats", s.GetGatewayStats)
+	router.HandleFunc("/api/gateway/{network_id}/{gateway_id}/footprint.geojson", s.GetGatewayFootprint)
+	router.HandleFunc("/api/coverage", s.GetCoverage).Methods(http.MethodGet)
+	router.HandleFunc("/api/coverage", s.PostCoverage).Methods(http.MethodPost)
+
+	// OGC services
+	router.HandleFunc("/wms", s.GetWms)
+
+	return router
 }
 
 func Index(w http.ResponseWriter, r *http.Request) {
@@ -214,3 +308,14 @@ func loggingMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// Stop streamed responses that take longer than the timeout by failing their writes
+func writeDeadlineHandler(handler http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout))
+		if err != nil {
+			log.Println(err.Error())
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Tiles are drawn from the pre-aggregated grid_cells by default. The packets source aggregates the raw packets
+// into z19 cells on the fly, so that they can be filtered on properties that grid cells do not keep.
+// The experiment, device and user sources aggregate the packets of one experiment, device or user,
+// which are not kept apart in the grid_cells.
+const (
+	TileSourcePackets    = "packets"
+	TileSourceExperiment = "experiment"
+	TileSourceDevice     = "device"
+	TileSourceUser       = "user"
+)
+
+// Packet-backed tiles aggregate the packets on the fly, which takes too long for the large areas of low zoom tiles
+const packetTileMinZoom = 10
+
+// PacketFilter selects the packets that packet-backed tiles are aggregated from. Empty fields match all packets.
+type PacketFilter struct {
+	NetworkId string
+	GatewayId string
+
+	// Only the packets of this experiment. Without an experiment, device or user, packets that are part of an
+	// experiment are skipped like they are in the coverage map.
+	Experiment string
+
+	// Only the packets of a device, identified by its application and device ID, or of a user identifier
+	AppId string
+	DevId string
+	User  string
+
+	SpreadingFactors []uint8
+	Bandwidths       []uint64 // Hz
+	Frequencies      []uint64 // Hz
+	CodingRates      []string // like 4/5
+}
+
+// Return the packet filter selected by the spreading_factor, bandwidth, frequency and coding_rate query parameters.
+// Every parameter is a comma separated list of values, a packet has to match one value of every list.
+func GetRequestPacketFilter(r *http.Request) (PacketFilter, error) {
+	query := r.URL.Query()
+	filter := PacketFilter{}
+
+	for _, value := range splitQueryList(query.Get("spreading_factor")) {
+		spreadingFactor, err := strconv.ParseUint(value, 10, 8)
+		if err != nil || spreadingFactor < 5 || spreadingFactor > 12 {
+			return filter, errors.New("spreading_factor invalid")
+		}
+		filter.SpreadingFactors = append(filter.SpreadingFactors, uint8(spreadingFactor))
+	}
+
+	for _, value := range splitQueryList(query.Get("bandwidth")) {
+		bandwidth, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || bandwidth == 0 {
+			return filter, errors.New("bandwidth invalid")
+		}
+		filter.Bandwidths = append(filter.Bandwidths, bandwidth)
+	}
+
+	for _, value := range splitQueryList(query.Get("frequency")) {
+		frequency, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || frequency == 0 {
+			return filter, errors.New("frequency invalid")
+		}
+		filter.Frequencies = append(filter.Frequencies, frequency)
+	}
+
+	filter.CodingRates = splitQueryList(query.Get("coding_rate"))
+
+	return filter, nil
+}
+
+// Split a comma separated query parameter, ignoring empty values
+func splitQueryList(value string) []string {
+	var values []string
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			values = append(values, part)
+		}
+	}
+	return values
+}
+
+// Name used to tell tiles with different packet filters apart in the disk cache. Empty if no packets are filtered out.
+// The network, gateway, experiment, device and user are not part of the name, as they are already part of the cache path.
+func (f PacketFilter) Name() string {
+	var parts []string
+	if len(f.SpreadingFactors) > 0 {
+		var values []string
+		for _, spreadingFactor := range f.SpreadingFactors {
+			values = append(values, strconv.Itoa(int(spreadingFactor)))
+		}
+		parts = append(parts, "sf"+strings.Join(values, "."))
+	}
+	if len(f.Bandwidths) > 0 {
+		var values []string
+		for _, bandwidth := range f.Bandwidths {
+			values = append(values, strconv.FormatUint(bandwidth, 10))
+		}
+		parts = append(parts, "bw"+strings.Join(values, "."))
+	}
+	if len(f.Frequencies) > 0 {
+		var values []string
+		for _, frequency := range f.Frequencies {
+			values = append(values, strconv.FormatUint(frequency, 10))
+		}
+		parts = append(parts, "f"+strings.Join(values, "."))
+	}
+	if len(f.CodingRates) > 0 {
+		parts = append(parts, "cr"+url.QueryEscape(strings.Join(f.CodingRates, ".")))
+	}
+	return strings.Join(parts, "-")
+}
+
+// Experiments are kept out of the coverage map, but are part of the measurements of a device or user
+func (f PacketFilter) SkipExperiments() bool {
+	return f.Experiment == "" && f.AppId == "" && f.User == ""
+}
+
+// The signal strength of a packet the same way the aggregator calculates it for grid cells:
+// below the noise floor the SNR is negative and is added to the RSSI.
+func GetPacketSignal(rssi float32, snr float32) float64 {
+	if snr < 0 {
+		return float64(rssi) + float64(snr)
+	}
+	return float64(rssi)
+}
+
+// Return the index of the grid cell bucket a signal falls in: bucket_high above -100dBm,
+// 5dB wide buckets down to -150dBm and bucket_low below that.
+func GetSignalBucketIndex(signal float64) int {
+	if signal > -100 {
+		return 0
+	}
+	return min(1+int(math.Floor((-100-signal)/5)), 11)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"ttnmapper-tms/types"
+)
+
+func TestGetSignalBucketIndex(t *testing.T) {
+	for _, test := range []struct {
+		rssi     float32
+		snr      float32
+		expected int
+	}{
+		{-95, 8, 0},
+		{-100, 8, 1},
+		{-104.5, 8, 1},
+		{-105, 8, 2},
+		{-120, -10, 7},
+		{-145, 2, 10},
+		{-140, -10, 11},
+		{-160, -20, 11},
+	} {
+		actual := GetSignalBucketIndex(GetPacketSignal(test.rssi, test.snr))
+		if actual != test.expected {
+			t.Errorf("%v dBm %v dB: expected bucket %d, got %d", test.rssi, test.snr, test.expected, actual)
+		}
+	}
+}
+
+func TestGetPacketSamplesInRange(t *testing.T) {
+	store := newTestStore(t)
+	xMin, yMin, xMax, yMax := GetZ19TileRangeBuffer(testTileX, testTileY, testTileZ, 0)
+
+	for _, test := range []struct {
+		filter   PacketFilter
+		expected int
+	}{
+		// The packets of the offline gateway and the deleted packet are skipped
+		{PacketFilter{NetworkId: testNetworkId}, 2},
+		{PacketFilter{NetworkId: testNetworkId, SpreadingFactors: []uint8{12}}, 1},
+		{PacketFilter{NetworkId: testNetworkId, SpreadingFactors: []uint8{7, 12}, Bandwidths: []uint64{125000}}, 2},
+		{PacketFilter{NetworkId: testNetworkId, Frequencies: []uint64{868100000}}, 1},
+		{PacketFilter{NetworkId: testNetworkId, CodingRates: []string{"4/6"}}, 0},
+		{PacketFilter{NetworkId: testNetworkId, GatewayId: testGatewayId}, 2},
+		{PacketFilter{NetworkId: testV3NetworkId}, 0},
+	} {
+		samples, err := GetPacketSamplesInRange(context.Background(), store, test.filter, xMin, yMin, xMax, yMax, CellAggregation{}, TimeWindow{}, AntennaSelection{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(samples) != test.expected {
+			t.Errorf("%v: expected %d samples, got %d: %v", test.filter, test.expected, len(samples), samples)
+		}
+	}
+}
+
+func TestGetPacketsTile(t *testing.T) {
+	cacheDirBlocks := myConfiguration.CacheDirBlocks
+	defer func() { myConfiguration.CacheDirBlocks = cacheDirBlocks }()
+	myConfiguration.CacheDirBlocks = t.TempDir()
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	// Cell 289605,314725 was heard at SF7 with a strong signal and at SF12 with a weak one
+	tile := getTestResponse(t, server, "/blocks/packets/network/thethingsnetwork.org/14/9050/9835.png?spreading_factor=7", png.Decode)
+	assertPixel(t, tile, 40, 40, color.RGBA{R: 255, A: 255})
+	tile = getTestResponse(t, server, "/blocks/packets/network/thethingsnetwork.org/14/9050/9835.png?spreading_factor=12", png.Decode)
+	assertPixel(t, tile, 40, 40, color.RGBA{B: 255, A: 255})
+	tile = getTestResponse(t, server, "/circles/packets/gateway/thethingsnetwork.org/eui-60c5a8fffe761551/14/9050/9835.png?frequency=868300000&since_install=false", png.Decode)
+	assertPixel(t, tile, 44, 44, color.RGBA{B: 255, A: 255})
+
+	for _, query := range []string{"?spreading_factor=13", "?bandwidth=wide", "?frequency=-1"} {
+		resp, err := http.Get(server.URL + "/circles/packets/network/thethingsnetwork.org/14/9050/9835.png" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", query, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+
+	// Low zoom tiles cover too many packets to aggregate on the fly
+	resp, err := http.Get(server.URL + "/blocks/packets/network/thethingsnetwork.org/9/282/307.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %d below zoom %d, got %d", http.StatusNotFound, packetTileMinZoom, resp.StatusCode)
+	}
+}
+
+// A store whose packet queries wait to be released, and fail if their context is cancelled meanwhile
+type blockingPacketStore struct {
+	*MemoryStore
+	started     chan bool
+	startedOnce sync.Once
+	release     chan bool
+}
+
+func (s *blockingPacketStore) GetPacketGridCellsInRange(ctx context.Context, filter PacketFilter, xMin int, yMin int, xMax int, yMax int, window TimeWindow) ([]types.GridCell, error) {
+	s.startedOnce.Do(func() { close(s.started) })
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return s.MemoryStore.GetPacketGridCellsInRange(ctx, filter, xMin, yMin, xMax, yMax, window)
+}
+
+func TestGetPacketsTileLeaderCancelled(t *testing.T) {
+	store := &blockingPacketStore{MemoryStore: newTestStore(t), started: make(chan bool), release: make(chan bool)}
+	tileServer := NewTileServer(store)
+	router := tileServer.NewRouter()
+
+	// Keep the server side context of every request, to know when the first one is cancelled
+	requestContexts := make(chan context.Context, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestContexts <- r.Context()
+		router.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	path := "/blocks/packets/network/thethingsnetwork.org/14/9050/9835.png?spreading_factor=7"
+
+	// The first request starts the render and is then cancelled by its client
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(leaderCtx, http.MethodGet, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaderDone := make(chan bool)
+	go func() {
+		defer close(leaderDone)
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-store.started
+	leaderRequestCtx := <-requestContexts
+
+	// A second request for the same tile waits for that render
+	waiterDone := make(chan *http.Response)
+	go func() {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Error(err)
+		}
+		waiterDone <- resp
+	}()
+	for waiters := 0; waiters < 1; {
+		tileServer.renderCoalescer.mutex.Lock()
+		for _, call := range tileServer.renderCoalescer.calls {
+			waiters = call.waiters
+		}
+		tileServer.renderCoalescer.mutex.Unlock()
+		runtime.Gosched()
+	}
+
+	cancelLeader()
+	<-leaderRequestCtx.Done()
+	<-leaderDone
+	close(store.release)
+
+	resp := <-waiterDone
+	if resp == nil {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	tile, err := png.Decode(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPixel(t, tile, 40, 40, color.RGBA{R: 255, A: 255})
+}
+
+func TestGetPacketSamplesPerGatewayInRange(t *testing.T) {
+	store := newTestStore(t)
+	xMin, yMin, xMax, yMax := GetZ19TileRangeBuffer(testTileX, testTileY, testTileZ, 0)
+
+	// The two antennas of the test gateway are summed, the gateway that is offline by now is included
+	samples, err := GetPacketSamplesPerGatewayInRange(context.Background(), store, PacketFilter{Experiment: "drive-test-stellenbosch"}, xMin, yMin, xMax, yMax, CellAggregation{Mode: AggregationWorst}, TimeWindow{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 2 {
+		t.Fatalf("expected 2 samples, got %d: %v", len(samples), samples)
+	}
+	for _, sample := range samples {
+		if sample.X == 289625 && sample.MaxBucketIndex != 3 {
+			t.Errorf("expected bucket 3 for summed antennas, got %d", sample.MaxBucketIndex)
+		}
+	}
+
+	samples, err = GetPacketSamplesPerGatewayInRange(context.Background(), store, PacketFilter{Experiment: "unknown"}, xMin, yMin, xMax, yMax, CellAggregation{}, TimeWindow{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 0 {
+		t.Errorf("expected no samples, got %v", samples)
+	}
+}
+
+func TestGetExperimentTile(t *testing.T) {
+	cacheEnabled, cacheDirCircles := myConfiguration.CacheEnabled, myConfiguration.CacheDirCircles
+	defer func() { myConfiguration.CacheEnabled, myConfiguration.CacheDirCircles = cacheEnabled, cacheDirCircles }()
+	myConfiguration.CacheEnabled = true
+	myConfiguration.CacheDirCircles = t.TempDir()
+
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	tile := getTestResponse(t, server, "/circles/experiment/drive-test-stellenbosch/14/9050/9835.png", png.Decode)
+	assertPixel(t, tile, 204, 44, color.RGBA{R: 255, A: 255})
+	_, _, _, alpha := tile.At(44, 204).RGBA()
+	if alpha == 0 {
+		t.Error("expected the cell of the offline gateway to be drawn")
+	}
+	// Packets outside the experiment are not drawn
+	assertPixel(t, tile, 44, 44, color.RGBA{})
+
+	resp, err := http.Get(server.URL + "/blocks/experiment/drive-test-stellenbosch/14/9050/9835.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Last-Modified") != "Thu, 01 Apr 2021 10:00:00 GMT" {
+		t.Errorf("unexpected Last-Modified %s", resp.Header.Get("Last-Modified"))
+	}
+
+	// Experiment tiles are not cached, as the invalidator does not know when they change
+	_, err = os.Stat(myConfiguration.CacheDirCircles + "/experiment")
+	if err == nil {
+		t.Error("experiment tile was cached")
+	}
+}
+
+func TestGetDeviceAndUserTiles(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	// The device measured cell 289605,314725 and the cell of the offline gateway, but not cell 289625,314745
+	tile := getTestResponse(t, server, "/blocks/device/cape-trackers/tracker-01/14/9050/9835.png", png.Decode)
+	assertPixel(t, tile, 40, 40, color.RGBA{R: 255, A: 255})
+	assertPixel(t, tile, 200, 200, color.RGBA{})
+	_, _, _, alpha := tile.At(40, 200).RGBA()
+	if alpha == 0 {
+		t.Error("expected the cell of the offline gateway to be drawn")
+	}
+
+	// The measurements of a user include their experiments
+	tile = getTestResponse(t, server, "/circles/user/field-tester-2/14/9050/9835.png", png.Decode)
+	assertPixel(t, tile, 204, 44, color.RGBA{R: 255, A: 255})
+	assertPixel(t, tile, 44, 44, color.RGBA{})
+	_, _, _, alpha = tile.At(204, 204).RGBA()
+	if alpha == 0 {
+		t.Error("expected cell 289625,314745 to be drawn")
+	}
+
+	tile = getTestResponse(t, server, "/circles/device/cape-trackers/unknown/14/9050/9835.png", png.Decode)
+	assertPixel(t, tile, 44, 44, color.RGBA{})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Longest time a coalesced render may query the database for
+const renderTimeout = time.Minute
+
+// RenderCoalescer lets concurrent requests for the same tile wait for a single render instead of each
+// querying the database and drawing the tile themselves.
+type RenderCoalescer struct {
+	mutex sync.Mutex
+	calls map[string]*renderCall
+}
+
+type renderCall struct {
+	done chan struct{}
+	tile []byte
+	err  error
+
+	// Number of requests waiting for this render
+	waiters int
+}
+
+func NewRenderCoalescer() *RenderCoalescer {
+	return &RenderCoalescer{calls: map[string]*renderCall{}}
+}
+
+// Run render for the key, or if a render for the same key is already running, wait for it and return its result
+func (c *RenderCoalescer) Do(key string, render func() ([]byte, error)) ([]byte, error) {
+	c.mutex.Lock()
+	if call, ok := c.calls[key]; ok {
+		call.waiters++
+		c.mutex.Unlock()
+		promTmsRenderDeduplicatedCount.Inc()
+
+		<-call.done
+		return call.tile, call.err
+	}
+
+	call := &renderCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mutex.Unlock()
+
+	// Later requests start a new render, they may need newer data
+	defer func() {
+		c.mutex.Lock()
+		delete(c.calls, key)
+		c.mutex.Unlock()
+		close(call.done)
+	}()
+
+	call.tile, call.err = render()
+	return call.tile, call.err
+}
+
+// The context a coalesced render runs under. The render is shared by every request waiting for it, so it is not
+// cancelled when the request that started it is, only when it takes longer than renderTimeout.
+func renderContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), renderTimeout)
+}
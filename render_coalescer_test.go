@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRenderCoalescerDo(t *testing.T) {
+	coalescer := NewRenderCoalescer()
+
+	var renders atomic.Int32
+	started := make(chan bool)
+	release := make(chan bool)
+	render := func() ([]byte, error) {
+		if renders.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return []byte("tile"), nil
+	}
+
+	// The first request starts rendering, the others arrive while it is busy
+	var wg sync.WaitGroup
+	results := make([][]byte, 10)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], _ = coalescer.Do("circles/14/9050/9835", render)
+	}()
+	<-started
+
+	for i := 1; i < len(results); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = coalescer.Do("circles/14/9050/9835", render)
+		}(i)
+	}
+
+	// Wait until all requests are queued behind the running render
+	for waiters := 0; waiters < len(results)-1; {
+		coalescer.mutex.Lock()
+		waiters = coalescer.calls["circles/14/9050/9835"].waiters
+		coalescer.mutex.Unlock()
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+
+	for i, result := range results {
+		if !bytes.Equal(result, []byte("tile")) {
+			t.Errorf("request %d got %q", i, result)
+		}
+	}
+
+	// Once done, a new request renders again
+	_, _ = coalescer.Do("circles/14/9050/9835", func() ([]byte, error) {
+		renders.Add(1)
+		return nil, nil
+	})
+	if renders.Load() != 2 {
+		t.Errorf("expected 2 renders, got %d", renders.Load())
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SeedOptions describes which tiles the seed command pre-renders into the disk cache
+type SeedOptions struct {
+	NetworkId   string
+	GatewayId   string
+	BoundingBox BoundingBox
+	ZoomMin     int
+	ZoomMax     int
+	Layers      []string
+	Styles      []TileStyle
+	HighDpi     bool
+	Parallel    int
+	Force       bool
+}
+
+// RunSeed parses the arguments of the seed subcommand and renders all requested tiles, e.g.
+//
+//	tile-map-server seed -network NS_TTS_V3://ttn@000013 -bbox 18.8,-34.0,18.9,-33.9 -zoom 8-16
+func RunSeed(server *TileServer, args []string) error {
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	networkId := flags.String("network", "", "network ID to seed")
+	gatewayId := flags.String("gateway", "", "only seed the tiles of this gateway")
+	bbox := flags.String("bbox", "", "area to seed as minLon,minLat,maxLon,maxLat")
+	zoom := flags.String("zoom", "0-14", "zoom level or range of zoom levels, e.g. 12 or 8-16")
+	layers := flags.String("layers", "circles", "comma separated list of layers to seed: circles, blocks")
+	styles := flags.String("styles", myConfiguration.DefaultStyle, "comma separated list of styles to seed")
+	highDpi := flags.Bool("2x", false, "also seed the @2x tiles")
+	parallel := flags.Int("parallel", 4, "number of tiles rendered at the same time")
+	force := flags.Bool("force", false, "also render tiles that are still fresh in the cache")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	options := SeedOptions{
+		NetworkId: *networkId,
+		GatewayId: *gatewayId,
+		HighDpi:   *highDpi,
+		Parallel:  *parallel,
+		Force:     *force,
+	}
+	if options.NetworkId == "" {
+		return errors.New("network is required")
+	}
+	if options.Parallel < 1 {
+		return errors.New("parallel should be at least 1")
+	}
+
+	options.BoundingBox, err = ParseBoundingBox(*bbox)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Sscanf(*zoom, "%d-%d", &options.ZoomMin, &options.ZoomMax)
+	if err != nil {
+		_, err = fmt.Sscanf(*zoom, "%d", &options.ZoomMin)
+		if err != nil {
+			return errors.New("zoom invalid")
+		}
+		options.ZoomMax = options.ZoomMin
+	}
+	if options.ZoomMin < 0 || options.ZoomMax > 19 || options.ZoomMin > options.ZoomMax {
+		return errors.New("zoom out of range")
+	}
+
+	for _, layer := range strings.Split(*layers, ",") {
+		if layer != "circles" && layer != "blocks" {
+			return fmt.Errorf("unknown layer %s", layer)
+		}
+		options.Layers = append(options.Layers, layer)
+	}
+
+	for _, name := range strings.Split(*styles, ",") {
+		style, ok := tileStyles[name]
+		if !ok {
+			return fmt.Errorf("unknown style %s", name)
+		}
+		options.Styles = append(options.Styles, style)
+	}
+
+	if !myConfiguration.CacheEnabled {
+		log.Println("Warning: the cache is disabled, seeded tiles will not be served")
+	}
+
+	return server.SeedTiles(options)
+}
+
+// Render every tile in the seed options into the disk cache, with at most options.Parallel tiles at the same time
+func (s *TileServer) SeedTiles(options SeedOptions) error {
+	scales := []int{1}
+	if options.HighDpi {
+		scales = append(scales, 2)
+	}
+
+	// Gateway tiles are seeded like they are served by default, without the grid cells from before the gateway moved
+	baseRequest := TileRequest{
+		NetworkId:     options.NetworkId,
+		GatewayId:     options.GatewayId,
+		SingleGateway: options.GatewayId != "",
+		SinceInstall:  options.GatewayId != "",
+	}
+	_, err := ApplySinceInstall(s.store, &baseRequest)
+	if err != nil {
+		return err
+	}
+
+	// Count first so that progress can be reported as a percentage
+	total := 0
+	for z := options.ZoomMin; z <= options.ZoomMax; z++ {
+		xMin, yMin, xMax, yMax := options.BoundingBox.TileRange(z)
+		total += (xMax - xMin + 1) * (yMax - yMin + 1)
+	}
+	total *= len(scales) * len(options.Layers) * len(options.Styles)
+	log.Printf("Seeding %d tiles with %d workers\n", total, options.Parallel)
+
+	type seedJob struct {
+		layer       string
+		style       TileStyle
+		tileRequest TileRequest
+	}
+
+	jobs := make(chan seedJob)
+	var done, skipped, failed atomic.Int64
+	var wg sync.WaitGroup
+
+	for i := 0; i < options.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				rendered, err := s.seedTile(job.layer, job.tileRequest, job.style, options.Force)
+				if err != nil {
+					log.Printf("Seeding %s %d/%d/%d failed: %s\n", job.layer, job.tileRequest.Z, job.tileRequest.X, job.tileRequest.Y, err.Error())
+					failed.Add(1)
+				} else if !rendered {
+					skipped.Add(1)
+				}
+				done.Add(1)
+			}
+		}()
+	}
+
+	// Report progress while the workers are busy
+	stopProgress := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				log.Printf("Seeded %d/%d tiles (%.1f%%)\n", done.Load(), total, 100*float64(done.Load())/float64(max(total, 1)))
+			case <-stopProgress:
+				return
+			}
+		}
+	}()
+
+	for z := options.ZoomMin; z <= options.ZoomMax; z++ {
+		xMin, yMin, xMax, yMax := options.BoundingBox.TileRange(z)
+		for x := xMin; x <= xMax; x++ {
+			for y := yMin; y <= yMax; y++ {
+				for _, scale := range scales {
+					tileRequest := baseRequest
+					tileRequest.Z, tileRequest.X, tileRequest.Y = z, x, y
+					tileRequest.Scale = scale
+					for _, layer := range options.Layers {
+						for _, style := range options.Styles {
+							jobs <- seedJob{layer: layer, style: style, tileRequest: tileRequest}
+						}
+					}
+				}
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	close(stopProgress)
+
+	log.Printf("Seeded %d tiles, %d were still fresh in the cache, %d failed\n", done.Load(), skipped.Load(), failed.Load())
+	if failed.Load() > 0 {
+		return fmt.Errorf("%d tiles failed", failed.Load())
+	}
+	return nil
+}
+
+// Render one tile into the disk cache. Returns false if the tile was still fresh and was not rendered.
+func (s *TileServer) seedTile(layer string, tileRequest TileRequest, style TileStyle, force bool) (bool, error) {
+	var tileFileName string
+	if layer == "blocks" {
+		tileFileName = GetBlocksTileFileName(tileRequest, style)
+	} else {
+		tileFileName = GetCirclesTileFileName(tileRequest, style)
+	}
+
+	if _, cached := TileInCache(tileFileName, tileRequest.Z); cached && !force {
+		return false, nil
+	}
+
+	// The version is stored with the tile, so that it is served with the same validators as a rendered tile
+	xMin, yMin, xMax, yMax := getLayerTileRange(tileRequest, layer == "blocks")
+	version, err := GetTileVersion(context.Background(), s.store, tileRequest, xMin, yMin, xMax, yMax)
+	if err != nil {
+		return false, err
+	}
+
+	var tile image.Image
+	if layer == "blocks" {
+		tile, err = s.RenderBlocksTile(context.Background(), tileRequest, style)
+	} else {
+		tile, err = s.RenderCirclesTile(context.Background(), tileRequest, style)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	StoreTileInFile(tile, tileFileName, version)
+	return true, nil
+}
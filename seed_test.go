@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRunSeed(t *testing.T) {
+	cacheDirCircles, cacheDirBlocks := myConfiguration.CacheDirCircles, myConfiguration.CacheDirBlocks
+	defer func() {
+		myConfiguration.CacheDirCircles, myConfiguration.CacheDirBlocks = cacheDirCircles, cacheDirBlocks
+	}()
+	myConfiguration.CacheDirCircles = t.TempDir()
+	myConfiguration.CacheDirBlocks = t.TempDir()
+	server := NewTileServer(newTestStore(t))
+
+	err := RunSeed(server, []string{"-network", testNetworkId, "-bbox", testTileBbox(), "-zoom", "13-14", "-layers", "circles,blocks", "-2x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tileFileName := range []string{
+		myConfiguration.CacheDirCircles + "/network/thethingsnetwork.org/13/4525/4917/classic.png",
+		myConfiguration.CacheDirCircles + "/network/thethingsnetwork.org/14/9050/9835/classic.png",
+		myConfiguration.CacheDirCircles + "/network/thethingsnetwork.org/14/9050/9835/classic@2x.png",
+		myConfiguration.CacheDirBlocks + "/network/thethingsnetwork.org/14/9050/9835/classic.png",
+	} {
+		_, err = os.Stat(tileFileName)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Unknown layers and missing arguments are rejected
+	for _, args := range [][]string{
+		{"-bbox", testTileBbox()},
+		{"-network", testNetworkId, "-bbox", testTileBbox(), "-layers", "hexagons"},
+		{"-network", testNetworkId, "-bbox", testTileBbox(), "-zoom", "16-12"},
+	} {
+		err = RunSeed(server, args)
+		if err == nil {
+			t.Errorf("expected error for %v", args)
+		}
+	}
+}
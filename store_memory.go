@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"ttnmapper-tms/types"
+)
+
+// MemoryStore keeps coverage data in memory. It is seeded from a JSON fixture file
+// so that tiles can be rendered and tested without a Postgres database.
+type MemoryStore struct {
+	Gateways  []types.Gateway
+	Antennas  []types.Antenna
+	GridCells []types.GridCell
+
+	GatewayLocations      []types.GatewayLocation
+	GatewayLocationForces []types.GatewayLocationForce
+
+	Packets     []types.Packet
+	DataRates   []types.DataRate
+	Frequencies []types.Frequency
+	CodingRates []types.CodingRate
+	Experiments []types.Experiment
+	Devices     []types.Device
+	Users       []types.User
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// Load a MemoryStore from a JSON file containing the Gateways, Antennas, GridCells, GatewayLocations and
+// GatewayLocationForces lists, and optionally Packets with the DataRates, Frequencies, CodingRates, Experiments, Devices and Users they refer to
+func LoadMemoryStore(filename string) (*MemoryStore, error) {
+	store := NewMemoryStore()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return store, err
+	}
+
+	err = json.Unmarshal(data, store)
+	return store, err
+}
+
+func (s *MemoryStore) GetNetworkGridCellsInRange(networkId string, xMin int, yMin int, xMax int, yMax int, window TimeWindow) ([]types.GridCell, error) {
+	var gridCells []types.GridCell
+
+	for _, gridCell := range s.GridCells {
+		antenna, ok := s.getAntenna(gridCell.AntennaID)
+		if !ok || antenna.NetworkId != networkId {
+			continue
+		}
+		if gridCellInRange(gridCell, xMin, yMin, xMax, yMax) && window.Contains(gridCell.LastUpdated) {
+			gridCells = append(gridCells, gridCell)
+		}
+	}
+
+	return gridCells, nil
+}
+
+func (s *MemoryStore) GetGatewayGridCellsInRange(networkId string, gatewayId string, xMin int, yMin int, xMax int, yMax int, window TimeWindow) ([]types.GridCell, error) {
+	var gridCells []types.GridCell
+
+	for _, gridCell := range s.GridCells {
+		antenna, ok := s.getAntenna(gridCell.AntennaID)
+		if !ok || antenna.NetworkId != networkId || antenna.GatewayId != gatewayId {
+			continue
+		}
+		if gridCellInRange(gridCell, xMin, yMin, xMax, yMax) && window.Contains(gridCell.LastUpdated) {
+			gridCells = append(gridCells, gridCell)
+		}
+	}
+
+	return gridCells, nil
+}
+
+func (s *MemoryStore) GetPacketGridCellsInRange(ctx context.Context, filter PacketFilter, xMin int, yMin int, xMax int, yMax int, window TimeWindow) ([]types.GridCell, error) {
+	var gridCells []types.GridCell
+	cellIndexes := map[types.GridCellIndexer]int{}
+
+	for _, packet := range s.Packets {
+		if packet.DeletedAt != nil || !window.Contains(packet.Time) || !s.packetMatches(packet, filter) {
+			continue
+		}
+
+		x, y := packetCell(packet)
+		if x < xMin || x > xMax || y < yMin || y > yMax {
+			continue
+		}
+
+		indexer := types.GridCellIndexer{AntennaId: packet.AntennaID, X: x, Y: y}
+		i, ok := cellIndexes[indexer]
+		if !ok {
+			i = len(gridCells)
+			cellIndexes[indexer] = i
+			gridCells = append(gridCells, types.GridCell{AntennaID: packet.AntennaID, X: x, Y: y})
+		}
+
+		*gridCellBucketPointers(&gridCells[i])[GetSignalBucketIndex(GetPacketSignal(packet.Rssi, packet.Snr))]++
+		if packet.Time.After(gridCells[i].LastUpdated) {
+			gridCells[i].LastUpdated = packet.Time
+		}
+	}
+
+	return gridCells, nil
+}
+
+func (s *MemoryStore) GetPacketLastUpdatedInRange(ctx context.Context, filter PacketFilter, xMin int, yMin int, xMax int, yMax int) (time.Time, error) {
+	var lastUpdated time.Time
+	for _, packet := range s.Packets {
+		if packet.DeletedAt != nil || !s.packetMatches(packet, filter) {
+			continue
+		}
+		x, y := packetCell(packet)
+		if x >= xMin && x <= xMax && y >= yMin && y <= yMax && packet.Time.After(lastUpdated) {
+			lastUpdated = packet.Time
+		}
+	}
+	return lastUpdated, nil
+}
+
+func (s *MemoryStore) GetNetworkAntennasLastUpdatedInRange(networkId string, xMin int, yMin int, xMax int, yMax int) (map[uint]time.Time, error) {
+	gridCells, err := s.GetNetworkGridCellsInRange(networkId, xMin, yMin, xMax, yMax, TimeWindow{})
+	lastUpdated := map[uint]time.Time{}
+	for _, gridCell := range gridCells {
+		if gridCell.LastUpdated.After(lastUpdated[gridCell.AntennaID]) {
+			lastUpdated[gridCell.AntennaID] = gridCell.LastUpdated
+		}
+	}
+	return lastUpdated, err
+}
+
+func (s *MemoryStore) GetGatewayLastUpdatedInRange(networkId string, gatewayId string, xMin int, yMin int, xMax int, yMax int) (time.Time, error) {
+	gridCells, err := s.GetGatewayGridCellsInRange(networkId, gatewayId, xMin, yMin, xMax, yMax, TimeWindow{})
+	return newestGridCellUpdate(gridCells), err
+}
+
+func (s *MemoryStore) getGatewayLastHeard(networkId string, gatewayId string) time.Time {
+	for _, gateway := range s.Gateways {
+		if gateway.NetworkId == networkId && gateway.GatewayId == gatewayId {
+			return gateway.LastHeard
+		}
+	}
+	return time.Time{}
+}
+
+func (s *MemoryStore) GetAntennaStatuses(antennaIds []uint) (map[uint]types.AntennaStatus, error) {
+	statuses := map[uint]types.AntennaStatus{}
+
+	for _, antennaId := range antennaIds {
+		antenna, ok := s.getAntenna(antennaId)
+		if !ok {
+			continue
+		}
+
+		lastHeard := s.getGatewayLastHeard(antenna.NetworkId, antenna.GatewayId)
+		force, forced := s.getGatewayLocationForce(antenna.NetworkId, antenna.GatewayId)
+		installedAt, _ := s.GetGatewayInstalledAt(antenna.NetworkId, antenna.GatewayId)
+		statuses[antennaId] = types.AntennaStatus{
+			AntennaID:   antennaId,
+			LastHeard:   lastHeard,
+			Blacklisted: forced && force.Latitude == 0 && force.Longitude == 0,
+			InstalledAt: installedAt,
+		}
+	}
+
+	return statuses, nil
+}
+
+func (s *MemoryStore) GetGatewaysInBoundingBox(networkId string, boundingBox BoundingBox) ([]types.Gateway, error) {
+	var gateways []types.Gateway
+
+	for _, gateway := range s.Gateways {
+		if gateway.NetworkId != networkId {
+			continue
+		}
+		if force, ok := s.getGatewayLocationForce(gateway.NetworkId, gateway.GatewayId); ok {
+			if force.Latitude == 0 && force.Longitude == 0 {
+				continue
+			}
+			gateway.Latitude, gateway.Longitude = force.Latitude, force.Longitude
+		}
+		if gateway.Longitude >= boundingBox.MinLon && gateway.Longitude <= boundingBox.MaxLon &&
+			gateway.Latitude >= boundingBox.MinLat && gateway.Latitude <= boundingBox.MaxLat {
+			gateways = append(gateways, gateway)
+		}
+	}
+
+	return gateways, nil
+}
+
+func (s *MemoryStore) GetGateway(networkId string, gatewayId string) (types.Gateway, bool, error) {
+	for _, gateway := range s.Gateways {
+		if gateway.NetworkId != networkId || gateway.GatewayId != gatewayId {
+			continue
+		}
+		if force, ok := s.getGatewayLocationForce(gateway.NetworkId, gateway.GatewayId); ok {
+			if force.Latitude == 0 && force.Longitude == 0 {
+				return types.Gateway{}, false, nil
+			}
+			gateway.Latitude, gateway.Longitude = force.Latitude, force.Longitude
+		}
+		return gateway, true, nil
+	}
+
+	return types.Gateway{}, false, nil
+}
+
+func (s *MemoryStore) GetNetworks(query ListQuery) ([]types.NetworkSummary, error) {
+	var networks []types.NetworkSummary
+	gatewayCounts := map[string]int{}
+
+	for _, gateway := range s.Gateways {
+		if !strings.HasPrefix(gateway.NetworkId, query.Prefix) {
+			continue
+		}
+		if force, ok := s.getGatewayLocationForce(gateway.NetworkId, gateway.GatewayId); ok && force.Latitude == 0 && force.Longitude == 0 {
+			continue
+		}
+		if gatewayCounts[gateway.NetworkId] == 0 {
+			networks = append(networks, types.NetworkSummary{NetworkId: gateway.NetworkId})
+		}
+		gatewayCounts[gateway.NetworkId]++
+	}
+
+	for i := range networks {
+		networks[i].GatewayCount = gatewayCounts[networks[i].NetworkId]
+	}
+	slices.SortFunc(networks, func(a, b types.NetworkSummary) int {
+		return strings.Compare(a.NetworkId, b.NetworkId)
+	})
+
+	return listPage(networks, query), nil
+}
+
+func (s *MemoryStore) GetNetworkGateways(networkId string, boundingBox *BoundingBox, query ListQuery) ([]types.GatewaySummary, error) {
+	if boundingBox == nil {
+		boundingBox = &BoundingBox{MinLon: -180, MinLat: -90, MaxLon: 180, MaxLat: 90}
+	}
+	gateways, _ := s.GetGatewaysInBoundingBox(networkId, *boundingBox)
+
+	var summaries []types.GatewaySummary
+	for _, gateway := range gateways {
+		if !strings.HasPrefix(gateway.GatewayId, query.Prefix) {
+			continue
+		}
+
+		summary := types.GatewaySummary{Gateway: gateway}
+		for _, antenna := range s.Antennas {
+			if antenna.NetworkId == gateway.NetworkId && antenna.GatewayId == gateway.GatewayId {
+				summary.AntennaCount++
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	slices.SortFunc(summaries, func(a, b types.GatewaySummary) int {
+		return strings.Compare(a.GatewayId, b.GatewayId)
+	})
+
+	return listPage(summaries, query), nil
+}
+
+func (s *MemoryStore) GetGatewayInstalledAt(networkId string, gatewayId string) (time.Time, error) {
+	var installedAt time.Time
+
+	for _, location := range s.GatewayLocations {
+		if location.NetworkId == networkId && location.GatewayId == gatewayId && location.InstalledAt.After(installedAt) {
+			installedAt = location.InstalledAt
+		}
+	}
+
+	return installedAt, nil
+}
+
+func (s *MemoryStore) GetGatewayLocationForce(networkId string, gatewayId string) (types.GatewayLocationForce, bool, error) {
+	force, ok := s.getGatewayLocationForce(networkId, gatewayId)
+	return force, ok, nil
+}
+
+func (s *MemoryStore) GetAntenna(antennaId uint) (types.Antenna, error) {
+	antenna, ok := s.getAntenna(antennaId)
+	if !ok {
+		return antenna, errors.New("antenna not found")
+	}
+	return antenna, nil
+}
+
+func (s *MemoryStore) GetGridCellUpdatesSince(since time.Time) ([]types.GridCellUpdate, error) {
+	var updates []types.GridCellUpdate
+
+	for _, gridCell := range s.GridCells {
+		if !gridCell.LastUpdated.After(since) {
+			continue
+		}
+		antenna, ok := s.getAntenna(gridCell.AntennaID)
+		if !ok {
+			continue
+		}
+		updates = append(updates, types.GridCellUpdate{
+			NetworkId:   antenna.NetworkId,
+			GatewayId:   antenna.GatewayId,
+			X:           gridCell.X,
+			Y:           gridCell.Y,
+			LastUpdated: gridCell.LastUpdated,
+		})
+	}
+
+	return updates, nil
+}
+
+func (s *MemoryStore) getAntenna(antennaId uint) (types.Antenna, bool) {
+	for _, antenna := range s.Antennas {
+		if antenna.ID == antennaId {
+			return antenna, true
+		}
+	}
+	return types.Antenna{}, false
+}
+
+func (s *MemoryStore) packetMatches(packet types.Packet, filter PacketFilter) bool {
+	antenna, ok := s.getAntenna(packet.AntennaID)
+	if !ok {
+		return false
+	}
+	if filter.NetworkId != "" && antenna.NetworkId != filter.NetworkId {
+		return false
+	}
+	if filter.GatewayId != "" && antenna.GatewayId != filter.GatewayId {
+		return false
+	}
+
+	if filter.Experiment != "" {
+		var experiment types.Experiment
+		for _, candidate := range s.Experiments {
+			if packet.ExperimentID != nil && candidate.ID == *packet.ExperimentID {
+				experiment = candidate
+			}
+		}
+		if experiment.Name != filter.Experiment {
+			return false
+		}
+	}
+	if filter.SkipExperiments() && packet.ExperimentID != nil {
+		return false
+	}
+
+	if filter.AppId != "" {
+		var device types.Device
+		for _, candidate := range s.Devices {
+			if candidate.ID == packet.DeviceID {
+				device = candidate
+			}
+		}
+		if device.AppId != filter.AppId || device.DevId != filter.DevId {
+			return false
+		}
+	}
+
+	if filter.User != "" {
+		var user types.User
+		for _, candidate := range s.Users {
+			if candidate.ID == packet.UserID {
+				user = candidate
+			}
+		}
+		if user.Identifier != filter.User {
+			return false
+		}
+	}
+
+	var dataRate types.DataRate
+	for _, candidate := range s.DataRates {
+		if candidate.ID == packet.DataRateID {
+			dataRate = candidate
+		}
+	}
+	if len(filter.SpreadingFactors) > 0 && !slices.Contains(filter.SpreadingFactors, dataRate.SpreadingFactor) {
+		return false
+	}
+	if len(filter.Bandwidths) > 0 && !slices.Contains(filter.Bandwidths, dataRate.Bandwidth) {
+		return false
+	}
+
+	if len(filter.Frequencies) > 0 {
+		var frequency types.Frequency
+		for _, candidate := range s.Frequencies {
+			if candidate.ID == packet.FrequencyID {
+				frequency = candidate
+			}
+		}
+		if !slices.Contains(filter.Frequencies, frequency.Herz) {
+			return false
+		}
+	}
+
+	if len(filter.CodingRates) > 0 {
+		var codingRate types.CodingRate
+		for _, candidate := range s.CodingRates {
+			if candidate.ID == packet.CodingRateID {
+				codingRate = candidate
+			}
+		}
+		if !slices.Contains(filter.CodingRates, codingRate.Name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *MemoryStore) getGatewayLocationForce(networkId string, gatewayId string) (types.GatewayLocationForce, bool) {
+	for _, force := range s.GatewayLocationForces {
+		if force.NetworkId == networkId && force.GatewayId == gatewayId {
+			return force, true
+		}
+	}
+	return types.GatewayLocationForce{}, false
+}
+
+// Return the page of a sorted list a query selects
+func listPage[T any](items []T, query ListQuery) []T {
+	if query.Offset >= len(items) {
+		return nil
+	}
+	items = items[query.Offset:]
+	if query.Limit > 0 && query.Limit < len(items) {
+		items = items[:query.Limit]
+	}
+	return items
+}
+
+// The z19 cell a packet was measured in
+func packetCell(packet types.Packet) (int, int) {
+	return int(math.Floor(LonToTileX(packet.Longitude, 19))), int(math.Floor(LatToTileY(packet.Latitude, 19)))
+}
+
+func newestGridCellUpdate(gridCells []types.GridCell) time.Time {
+	var lastUpdated time.Time
+	for _, gridCell := range gridCells {
+		if gridCell.LastUpdated.After(lastUpdated) {
+			lastUpdated = gridCell.LastUpdated
+		}
+	}
+	return lastUpdated
+}
+
+func gridCellInRange(gridCell types.GridCell, xMin int, yMin int, xMax int, yMax int) bool {
+	return gridCell.X >= xMin && gridCell.X <= xMax && gridCell.Y >= yMin && gridCell.Y <= yMax
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/patrickmn/go-cache"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
+	"time"
+	"ttnmapper-tms/types"
+)
+
+// PostgresStore reads coverage data from the ttnmapper database
+type PostgresStore struct {
+	db *gorm.DB
+
+	antennaCache       *cache.Cache
+	antennaStatusCache *cache.Cache
+
+	gatewayLocationForceCache *cache.Cache
+	gatewayInstalledAtCache   *cache.Cache
+}
+
+func NewPostgresStore(db *gorm.DB) *PostgresStore {
+	return &PostgresStore{
+		db:                 db,
+		antennaCache:       cache.New(time.Hour, 10*time.Minute),
+		antennaStatusCache: cache.New(5*time.Minute, 1*time.Minute),
+
+		gatewayLocationForceCache: cache.New(10*time.Minute, time.Minute),
+		gatewayInstalledAtCache:   cache.New(10*time.Minute, time.Minute),
+	}
+}
+
+func (s *PostgresStore) GetNetworkGridCellsInRange(networkId string, xMin int, yMin int, xMax int, yMax int, window TimeWindow) ([]types.GridCell, error) {
+	var gridCells []types.GridCell
+
+	// Group by x and y and sum all buckets
+	query := whereTimeWindow(s.db.Table("grid_cells"), window)
+	err := query.
+		Select("antenna_id, x, y, max(last_updated) as last_updated, sum(bucket_high) as bucket_high, "+
+			"sum(bucket100) as bucket100, sum(bucket105) as bucket105, "+
+			"sum(bucket110) as bucket110, sum(bucket115) as bucket115, "+
+			"sum(bucket120) as bucket120, sum(bucket125) as bucket125, "+
+			"sum(bucket130) as bucket130, sum(bucket135) as bucket135, "+
+			"sum(bucket140) as bucket140, sum(bucket145) as bucket145, "+
+			"sum(bucket_low) as bucket_low, sum(bucket_no_signal) as bucket_no_signal").
+		Joins("left join antennas on antennas.id = grid_cells.antenna_id").
+		Where("antennas.network_id= ?", networkId).
+		Where("x >= ? AND x <= ? AND y >= ? AND y <= ?", xMin, xMax, yMin, yMax).
+		Group("antenna_id, x, y").
+		Find(&gridCells).Error
+
+	return gridCells, err
+}
+
+func (s *PostgresStore) GetGatewayGridCellsInRange(networkId string, gatewayId string, xMin int, yMin int, xMax int, yMax int, window TimeWindow) ([]types.GridCell, error) {
+	var gridCells []types.GridCell
+
+	// Group by x and y and sum all buckets
+	query := whereTimeWindow(s.db.Table("grid_cells"), window)
+	err := query.
+		Select("antenna_id, x, y, max(last_updated) as last_updated, sum(bucket_high) as bucket_high, "+
+			"sum(bucket100) as bucket100, sum(bucket105) as bucket105, "+
+			"sum(bucket110) as bucket110, sum(bucket115) as bucket115, "+
+			"sum(bucket120) as bucket120, sum(bucket125) as bucket125, "+
+			"sum(bucket130) as bucket130, sum(bucket135) as bucket135, "+
+			"sum(bucket140) as bucket140, sum(bucket145) as bucket145, "+
+			"sum(bucket_low) as bucket_low, sum(bucket_no_signal) as bucket_no_signal").
+		Joins("left join antennas on antennas.id = grid_cells.antenna_id").
+		Where("antennas.network_id= ?", networkId).
+		Where("antennas.gateway_id = ?", gatewayId).
+		Where("x >= ? AND x <= ? AND y >= ? AND y <= ?", xMin, xMax, yMin, yMax).
+		Group("antenna_id, x, y").
+		Find(&gridCells).Error
+
+	return gridCells, err
+}
+
+func (s *PostgresStore) GetPacketGridCellsInRange(ctx context.Context, filter PacketFilter, xMin int, yMin int, xMax int, yMax int, window TimeWindow) ([]types.GridCell, error) {
+	var gridCells []types.GridCell
+
+	// The query is cancelled with the request, as aggregating packets on the fly can take long
+	db := s.db.WithContext(ctx)
+
+	// Select the packets on their indexed coordinates first and calculate their z19 cell and signal
+	packets := wherePacketFilter(db.Table("packets"), filter, xMin, yMin, xMax, yMax, window).
+		Select("packets.antenna_id, packets.time, " +
+			"floor((packets.longitude + 180) / 360 * 524288)::int as x, " +
+			"floor((1 - ln(tan(radians(packets.latitude)) + 1 / cos(radians(packets.latitude))) / pi()) / 2 * 524288)::int as y, " +
+			"case when packets.snr < 0 then packets.rssi + packets.snr else packets.rssi end as signal")
+
+	// Then count the packets per antenna per cell into the same buckets as the grid_cells
+	err := db.Table("(?) as packets", packets).
+		Select("antenna_id, x, y, max(time) as last_updated, "+packetBucketColumns()).
+		Where("x >= ? AND x <= ? AND y >= ? AND y <= ?", xMin, xMax, yMin, yMax).
+		Group("antenna_id, x, y").
+		Find(&gridCells).Error
+
+	return gridCells, err
+}
+
+func (s *PostgresStore) GetPacketLastUpdatedInRange(ctx context.Context, filter PacketFilter, xMin int, yMin int, xMax int, yMax int) (time.Time, error) {
+	type Result struct {
+		LastUpdated *time.Time
+	}
+
+	var result Result
+	err := wherePacketFilter(s.db.WithContext(ctx).Table("packets"), filter, xMin, yMin, xMax, yMax, TimeWindow{}).
+		Select("max(packets.time) as last_updated").
+		Scan(&result).Error
+
+	if err != nil || result.LastUpdated == nil {
+		return time.Time{}, err
+	}
+	return *result.LastUpdated, nil
+}
+
+// Only select the packets matching the filter and window that fall in a range of z19 x and y indexes.
+// The z19 range is converted to coordinates, so that the indexes on latitude and longitude are used.
+func wherePacketFilter(query *gorm.DB, filter PacketFilter, xMin int, yMin int, xMax int, yMax int, window TimeWindow) *gorm.DB {
+	query = query.Joins("join antennas on antennas.id = packets.antenna_id").
+		Where("packets.deleted_at is null").
+		Where("packets.longitude >= ? AND packets.longitude < ?", TileXToLon(float64(xMin), 19), TileXToLon(float64(xMax+1), 19)).
+		Where("packets.latitude <= ? AND packets.latitude > ?", TileYToLat(float64(yMin), 19), TileYToLat(float64(yMax+1), 19))
+
+	if filter.NetworkId != "" {
+		query = query.Where("antennas.network_id = ?", filter.NetworkId)
+	}
+	if filter.GatewayId != "" {
+		query = query.Where("antennas.gateway_id = ?", filter.GatewayId)
+	}
+	if filter.Experiment != "" {
+		query = query.Joins("join experiments on experiments.id = packets.experiment_id").
+			Where("experiments.name = ?", filter.Experiment)
+	}
+	if filter.SkipExperiments() {
+		query = query.Where("packets.experiment_id is null")
+	}
+	if filter.AppId != "" {
+		query = query.Joins("join devices on devices.id = packets.device_id").
+			Where("devices.app_id = ? AND devices.dev_id = ?", filter.AppId, filter.DevId)
+	}
+	if filter.User != "" {
+		query = query.Joins("join users on users.id = packets.user_id").
+			Where("users.identifier = ?", filter.User)
+	}
+	if len(filter.SpreadingFactors) > 0 || len(filter.Bandwidths) > 0 {
+		query = query.Joins("join data_rates on data_rates.id = packets.data_rate_id")
+		if len(filter.SpreadingFactors) > 0 {
+			query = query.Where("data_rates.spreading_factor in ?", filter.SpreadingFactors)
+		}
+		if len(filter.Bandwidths) > 0 {
+			query = query.Where("data_rates.bandwidth in ?", filter.Bandwidths)
+		}
+	}
+	if len(filter.Frequencies) > 0 {
+		query = query.Joins("join frequencies on frequencies.id = packets.frequency_id").
+			Where("frequencies.herz in ?", filter.Frequencies)
+	}
+	if len(filter.CodingRates) > 0 {
+		query = query.Joins("join coding_rates on coding_rates.id = packets.coding_rate_id").
+			Where("coding_rates.name in ?", filter.CodingRates)
+	}
+	if !window.Since.IsZero() {
+		query = query.Where("packets.time >= ?", window.Since)
+	}
+	if !window.Until.IsZero() {
+		query = query.Where("packets.time < ?", window.Until)
+	}
+
+	return query
+}
+
+// Count packets into the bucket columns of a grid cell, using the same bounds as GetSignalBucketIndex
+func packetBucketColumns() string {
+	columns := []string{"count(*) filter (where signal > -100) as bucket_high"}
+	for i := 1; i <= 10; i++ {
+		upper := -100 - 5*(i-1)
+		columns = append(columns, fmt.Sprintf("count(*) filter (where signal <= %d and signal > %d) as bucket%d", upper, upper-5, -upper))
+	}
+	columns = append(columns, "count(*) filter (where signal <= -150) as bucket_low", "0 as bucket_no_signal")
+	return strings.Join(columns, ", ")
+}
+
+// Only select the grid cells last updated in the window
+func whereTimeWindow(query *gorm.DB, window TimeWindow) *gorm.DB {
+	if !window.Since.IsZero() {
+		query = query.Where("last_updated >= ?", window.Since)
+	}
+	if !window.Until.IsZero() {
+		query = query.Where("last_updated < ?", window.Until)
+	}
+	return query
+}
+
+func (s *PostgresStore) GetNetworkAntennasLastUpdatedInRange(networkId string, xMin int, yMin int, xMax int, yMax int) (map[uint]time.Time, error) {
+	var results []struct {
+		AntennaID   uint
+		LastUpdated time.Time
+	}
+	err := s.db.Table("grid_cells").
+		Select("grid_cells.antenna_id, max(last_updated) as last_updated").
+		Joins("left join antennas on antennas.id = grid_cells.antenna_id").
+		Where("antennas.network_id= ?", networkId).
+		Where("x >= ? AND x <= ? AND y >= ? AND y <= ?", xMin, xMax, yMin, yMax).
+		Group("grid_cells.antenna_id").
+		Scan(&results).Error
+	if err != nil {
+		return nil, err
+	}
+
+	lastUpdated := make(map[uint]time.Time, len(results))
+	for _, result := range results {
+		lastUpdated[result.AntennaID] = result.LastUpdated
+	}
+	return lastUpdated, nil
+}
+
+func (s *PostgresStore) GetGatewayLastUpdatedInRange(networkId string, gatewayId string, xMin int, yMin int, xMax int, yMax int) (time.Time, error) {
+	type Result struct {
+		LastUpdated *time.Time
+	}
+
+	var result Result
+	err := s.db.Table("grid_cells").
+		Select("max(last_updated) as last_updated").
+		Joins("left join antennas on antennas.id = grid_cells.antenna_id").
+		Where("antennas.network_id= ?", networkId).
+		Where("antennas.gateway_id = ?", gatewayId).
+		Where("x >= ? AND x <= ? AND y >= ? AND y <= ?", xMin, xMax, yMin, yMax).
+		Scan(&result).Error
+
+	if err != nil || result.LastUpdated == nil {
+		return time.Time{}, err
+	}
+	return *result.LastUpdated, nil
+}
+
+// Antennas are looked up in batches, to stay well below the maximum number of query parameters
+const antennaStatusBatchSize = 5000
+
+func (s *PostgresStore) GetAntennaStatuses(antennaIds []uint) (map[uint]types.AntennaStatus, error) {
+	statuses := map[uint]types.AntennaStatus{}
+
+	var missingIds []uint
+	for _, antennaId := range antennaIds {
+		if _, ok := statuses[antennaId]; ok {
+			continue
+		}
+		if status, ok := s.antennaStatusCache.Get(strconv.Itoa(int(antennaId))); ok {
+			statuses[antennaId] = status.(types.AntennaStatus)
+		} else {
+			missingIds = append(missingIds, antennaId)
+		}
+	}
+
+	for start := 0; start < len(missingIds); start += antennaStatusBatchSize {
+		batch := missingIds[start:min(start+antennaStatusBatchSize, len(missingIds))]
+
+		// Gateways that never moved have no installation time
+		var results []struct {
+			AntennaID   uint
+			LastHeard   time.Time
+			Blacklisted bool
+			InstalledAt *time.Time
+		}
+		err := s.db.Table("antennas").
+			Select("antennas.id as antenna_id, g.last_heard, "+
+				"coalesce(f.latitude = 0 AND f.longitude = 0, false) as blacklisted, "+
+				"(SELECT max(l.installed_at) FROM gateway_locations l "+
+				"WHERE l.network_id = antennas.network_id AND l.gateway_id = antennas.gateway_id) as installed_at").
+			Joins("JOIN gateways g on antennas.gateway_id = g.gateway_id and antennas.network_id = g.network_id").
+			Joins("LEFT JOIN gateway_location_forces f on antennas.gateway_id = f.gateway_id and antennas.network_id = f.network_id").
+			Where("antennas.id IN ?", batch).
+			Scan(&results).Error
+		if err != nil {
+			return statuses, err
+		}
+
+		for _, result := range results {
+			status := types.AntennaStatus{AntennaID: result.AntennaID, LastHeard: result.LastHeard, Blacklisted: result.Blacklisted}
+			if result.InstalledAt != nil {
+				status.InstalledAt = *result.InstalledAt
+			}
+			statuses[status.AntennaID] = status
+			s.antennaStatusCache.Set(strconv.Itoa(int(status.AntennaID)), status, cache.DefaultExpiration)
+		}
+		promAntennaStatusCacheItemCount.Set(float64(s.antennaStatusCache.ItemCount()))
+	}
+
+	return statuses, nil
+}
+
+// A forced location replaces the location the gateway reports
+const (
+	gatewayLatitude  = "coalesce(gateway_location_forces.latitude, gateways.latitude)"
+	gatewayLongitude = "coalesce(gateway_location_forces.longitude, gateways.longitude)"
+)
+
+// Select the gateways of a network at their forced location, skipping blacklisted gateways
+func (s *PostgresStore) selectVisibleGateways(networkId string, extraColumns ...string) *gorm.DB {
+	columns := append([]string{"gateways.id, gateways.network_id, gateways.gateway_id, gateways.gateway_eui, " +
+		"gateways.description, " + gatewayLatitude + " as latitude, " + gatewayLongitude + " as longitude, " +
+		"gateways.altitude, gateways.location_accuracy, gateways.location_source, gateways.last_heard"}, extraColumns...)
+
+	return whereGatewayNotBlacklisted(s.db.Table("gateways")).
+		Select(strings.Join(columns, ", ")).
+		Where("gateways.network_id = ?", networkId)
+}
+
+// Join the forced locations of the gateways, skipping the gateways that are blacklisted by forcing them to 0,0
+func whereGatewayNotBlacklisted(query *gorm.DB) *gorm.DB {
+	return query.
+		Joins("left join gateway_location_forces on gateway_location_forces.network_id = gateways.network_id AND " +
+			"gateway_location_forces.gateway_id = gateways.gateway_id").
+		Where("gateway_location_forces.id is null OR gateway_location_forces.latitude != 0 OR gateway_location_forces.longitude != 0")
+}
+
+// Only select the gateways located inside a bounding box
+func whereGatewayInBoundingBox(query *gorm.DB, boundingBox BoundingBox) *gorm.DB {
+	return query.
+		Where(gatewayLongitude+" >= ? AND "+gatewayLongitude+" <= ?", boundingBox.MinLon, boundingBox.MaxLon).
+		Where(gatewayLatitude+" >= ? AND "+gatewayLatitude+" <= ?", boundingBox.MinLat, boundingBox.MaxLat)
+}
+
+func (s *PostgresStore) GetGatewaysInBoundingBox(networkId string, boundingBox BoundingBox) ([]types.Gateway, error) {
+	var gateways []types.Gateway
+
+	err := whereGatewayInBoundingBox(s.selectVisibleGateways(networkId), boundingBox).
+		Find(&gateways).Error
+
+	return gateways, err
+}
+
+func (s *PostgresStore) GetGateway(networkId string, gatewayId string) (types.Gateway, bool, error) {
+	var gateways []types.Gateway
+
+	err := s.selectVisibleGateways(networkId).
+		Where("gateways.gateway_id = ?", gatewayId).
+		Limit(1).
+		Find(&gateways).Error
+	if err != nil || len(gateways) == 0 {
+		return types.Gateway{}, false, err
+	}
+
+	return gateways[0], true, nil
+}
+
+func (s *PostgresStore) GetNetworks(query ListQuery) ([]types.NetworkSummary, error) {
+	var networks []types.NetworkSummary
+
+	// Blacklisted gateways are not counted, like they are not listed
+	err := whereGatewayNotBlacklisted(s.db.Table("gateways")).
+		Select("gateways.network_id, count(*) as gateway_count").
+		Where("gateways.network_id LIKE ?", likePrefix(query.Prefix)).
+		Group("gateways.network_id").
+		Order("gateways.network_id").
+		Offset(query.Offset).
+		Limit(query.Limit).
+		Scan(&networks).Error
+
+	return networks, err
+}
+
+func (s *PostgresStore) GetNetworkGateways(networkId string, boundingBox *BoundingBox, query ListQuery) ([]types.GatewaySummary, error) {
+	var gateways []types.GatewaySummary
+
+	antennaCount := "(SELECT count(*) FROM antennas WHERE antennas.network_id = gateways.network_id AND " +
+		"antennas.gateway_id = gateways.gateway_id) as antenna_count"
+	gatewayQuery := s.selectVisibleGateways(networkId, antennaCount).
+		Where("gateways.gateway_id LIKE ?", likePrefix(query.Prefix))
+	if boundingBox != nil {
+		gatewayQuery = whereGatewayInBoundingBox(gatewayQuery, *boundingBox)
+	}
+
+	err := gatewayQuery.
+		Order("gateways.gateway_id").
+		Offset(query.Offset).
+		Limit(query.Limit).
+		Scan(&gateways).Error
+
+	return gateways, err
+}
+
+// Return a LIKE pattern matching the values starting with prefix, escaping the wildcards in it
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+}
+
+func (s *PostgresStore) GetGatewayInstalledAt(networkId string, gatewayId string) (time.Time, error) {
+	key := networkId + "/" + gatewayId
+	if installedAt, ok := s.gatewayInstalledAtCache.Get(key); ok {
+		return installedAt.(time.Time), nil
+	}
+
+	type Result struct {
+		InstalledAt *time.Time
+	}
+
+	var result Result
+	err := s.db.Table("gateway_locations").
+		Select("max(installed_at) as installed_at").
+		Where("network_id = ? AND gateway_id = ?", networkId, gatewayId).
+		Scan(&result).Error
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	installedAt := time.Time{}
+	if result.InstalledAt != nil {
+		installedAt = *result.InstalledAt
+	}
+	s.gatewayInstalledAtCache.Set(key, installedAt, cache.DefaultExpiration)
+	return installedAt, nil
+}
+
+func (s *PostgresStore) GetGatewayLocationForce(networkId string, gatewayId string) (types.GatewayLocationForce, bool, error) {
+	key := networkId + "/" + gatewayId
+	if cached, ok := s.gatewayLocationForceCache.Get(key); ok {
+		force := cached.(*types.GatewayLocationForce)
+		if force == nil {
+			return types.GatewayLocationForce{}, false, nil
+		}
+		return *force, true, nil
+	}
+
+	var forces []types.GatewayLocationForce
+	err := s.db.Table("gateway_location_forces").
+		Where("network_id = ? AND gateway_id = ?", networkId, gatewayId).
+		Limit(1).
+		Find(&forces).Error
+	if err != nil {
+		return types.GatewayLocationForce{}, false, err
+	}
+
+	// Also cache that a gateway has no forced location, as that is the case for almost all gateways
+	if len(forces) == 0 {
+		s.gatewayLocationForceCache.Set(key, (*types.GatewayLocationForce)(nil), cache.DefaultExpiration)
+		return types.GatewayLocationForce{}, false, nil
+	}
+	s.gatewayLocationForceCache.Set(key, &forces[0], cache.DefaultExpiration)
+	return forces[0], true, nil
+}
+
+func (s *PostgresStore) GetAntenna(antennaId uint) (types.Antenna, error) {
+	// Antennas never change gateway, so they can be kept longer than their last heard time
+	if antenna, ok := s.antennaCache.Get(strconv.Itoa(int(antennaId))); ok {
+		return antenna.(types.Antenna), nil
+	}
+
+	var antenna types.Antenna
+	err := s.db.Table("antennas").
+		Select("id, network_id, gateway_id, antenna_index").
+		Where("id = ?", antennaId).
+		Take(&antenna).Error
+	if err != nil {
+		return antenna, err
+	}
+
+	s.antennaCache.Set(strconv.Itoa(int(antennaId)), antenna, cache.DefaultExpiration)
+	return antenna, nil
+}
+
+func (s *PostgresStore) GetGridCellUpdatesSince(since time.Time) ([]types.GridCellUpdate, error) {
+	var updates []types.GridCellUpdate
+
+	err := s.db.Table("grid_cells").
+		Select("antennas.network_id, antennas.gateway_id, x, y, max(last_updated) as last_updated").
+		Joins("join antennas on antennas.id = grid_cells.antenna_id").
+		Where("last_updated > ?", since).
+		Group("antennas.network_id, antennas.gateway_id, x, y").
+		Scan(&updates).Error
+
+	return updates, err
+}
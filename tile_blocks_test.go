@@ -0,0 +1,46 @@
+package main
+
+import (
+	"image/color"
+	"image/png"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetBlocksTile(t *testing.T) {
+	cacheDirBlocks := myConfiguration.CacheDirBlocks
+	defer func() { myConfiguration.CacheDirBlocks = cacheDirBlocks }()
+	myConfiguration.CacheDirBlocks = t.TempDir()
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	tile := getTestResponse(t, server, "/blocks/network/thethingsnetwork.org/14/9050/9835.png", png.Decode)
+	if tile.Bounds().Dx() != 256 || tile.Bounds().Dy() != 256 {
+		t.Fatalf("unexpected tile size %v", tile.Bounds())
+	}
+	// Cell 289610,314730 is the 8x8 block starting at pixel 80,80
+	assertPixel(t, tile, 80, 80, color.RGBA{R: 255, A: 255})
+	assertPixel(t, tile, 87, 87, color.RGBA{R: 255, A: 255})
+	assertPixel(t, tile, 88, 88, color.RGBA{})
+	assertPixel(t, tile, 160, 160, color.RGBA{R: 255, G: 255, A: 255})
+
+	tile = getTestResponse(t, server, "/blocks/gateway/thethingsnetwork.org/eui-60c5a8fffe761551/14/9050/9835.png?since_install=false", png.Decode)
+	assertPixel(t, tile, 80, 80, color.RGBA{R: 255, A: 255})
+}
+
+func TestGetBlocksTileHighDpi(t *testing.T) {
+	cacheDirBlocks := myConfiguration.CacheDirBlocks
+	defer func() { myConfiguration.CacheDirBlocks = cacheDirBlocks }()
+	myConfiguration.CacheDirBlocks = t.TempDir()
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	tile := getTestResponse(t, server, "/blocks/network/thethingsnetwork.org/14/9050/9835@2x.png", png.Decode)
+	if tile.Bounds().Dx() != 512 || tile.Bounds().Dy() != 512 {
+		t.Fatalf("unexpected tile size %v", tile.Bounds())
+	}
+	// Blocks are 16px instead of 8px
+	assertPixel(t, tile, 160, 160, color.RGBA{R: 255, A: 255})
+	assertPixel(t, tile, 175, 175, color.RGBA{R: 255, A: 255})
+	assertPixel(t, tile, 176, 176, color.RGBA{})
+}
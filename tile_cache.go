@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Return the path of a circles tile in the disk cache
+func GetCirclesTileFileName(tileRequest TileRequest, style TileStyle) string {
+	return getTileFileName(myConfiguration.CacheDirCircles, tileRequest, style.Name)
+}
+
+// Return the path of a blocks tile in the disk cache
+func GetBlocksTileFileName(tileRequest TileRequest, style TileStyle) string {
+	return getTileFileName(myConfiguration.CacheDirBlocks, tileRequest, style.Name)
+}
+
+// Return the path of a heatmap tile in the disk cache. Heatmaps have a single gradient instead of styles.
+func GetHeatmapTileFileName(tileRequest TileRequest) string {
+	return getTileFileName(myConfiguration.CacheDirHeatmap, tileRequest, "heatmap")
+}
+
+// All variants of a tile are stored in one directory per tile, so that they can be removed together.
+func getTileFileName(cacheDir string, tileRequest TileRequest, styleName string) string {
+	return fmt.Sprintf("%s/%s.png", getTileCacheDir(cacheDir, tileRequest), GetTileVariant(tileRequest, styleName))
+}
+
+// Return the name of the variant of a tile: the style name, followed by the source, further networks, packet filter,
+// aggregation, time window, offline gateways and since install option if they are not the defaults, and @2x for
+// high-DPI tiles. Gateway tiles apply the since install option to their time window.
+func GetTileVariant(tileRequest TileRequest, styleName string) string {
+	variant := styleName
+	if tileRequest.Source != "" {
+		variant += "-" + tileRequest.Source
+	}
+	if len(tileRequest.Networks) > 0 {
+		variant += "-networks" + url.QueryEscape(strings.Join(tileRequest.Networks, ","))
+	}
+	if filterName := tileRequest.PacketFilter.Name(); filterName != "" {
+		variant += "-" + filterName
+	}
+	if aggregationName := tileRequest.Aggregation.Name(); aggregationName != "" {
+		variant += "-" + aggregationName
+	}
+	if windowName := tileRequest.Window.Name(); windowName != "" {
+		variant += "-" + windowName
+	}
+	if tileRequest.IncludeOffline {
+		variant += "-offline"
+	}
+	if tileRequest.SinceInstall && !tileRequest.SingleGateway {
+		variant += "-sinceinstall"
+	}
+	if tileRequest.Scale == 2 {
+		variant += "@2x"
+	}
+	return variant
+}
+
+// Return the directory holding all cached variants of a tile
+func getTileCacheDir(cacheDir string, tileRequest TileRequest) string {
+	switch tileRequest.Source {
+	case TileSourceExperiment:
+		return fmt.Sprintf("%s/experiment/%s/%d/%d/%d", cacheDir,
+			url.QueryEscape(tileRequest.Experiment), tileRequest.Z, tileRequest.X, tileRequest.Y)
+	case TileSourceDevice:
+		return fmt.Sprintf("%s/device/%s/%s/%d/%d/%d", cacheDir,
+			url.QueryEscape(tileRequest.AppId), url.QueryEscape(tileRequest.DevId), tileRequest.Z, tileRequest.X, tileRequest.Y)
+	case TileSourceUser:
+		return fmt.Sprintf("%s/user/%s/%d/%d/%d", cacheDir,
+			url.QueryEscape(tileRequest.User), tileRequest.Z, tileRequest.X, tileRequest.Y)
+	}
+	if tileRequest.SingleGateway {
+		return fmt.Sprintf("%s/gateway/%s/%s/%d/%d/%d", cacheDir,
+			url.QueryEscape(tileRequest.NetworkId), url.QueryEscape(tileRequest.GatewayId), tileRequest.Z, tileRequest.X, tileRequest.Y)
+	}
+	return fmt.Sprintf("%s/network/%s/%d/%d/%d", cacheDir,
+		url.QueryEscape(tileRequest.NetworkId), tileRequest.Z, tileRequest.X, tileRequest.Y)
+}
+
+// Check if a tile exists in the disk cache and is still new enough to be served. Returns the version of the data
+// it was drawn from, which is stored with it. Tiles without a stored version are not served.
+func TileInCache(tileFileName string, z int) (TileVersion, bool) {
+	file, err := os.Stat(tileFileName)
+	if err != nil {
+		return TileVersion{}, false
+	}
+
+	// Check the last modified time of the file to see if the time is still new enough
+	cacheDuration := GetCacheDurationForZoom(z) * 2
+	if myConfiguration.CacheInvalidationInterval > 0 {
+		cacheDuration = GetCacheDurationForZoom(z) * invalidatedCacheDurationFactor
+	}
+	if !file.ModTime().Add(cacheDuration).After(time.Now()) {
+		return TileVersion{}, false
+	}
+
+	versionBytes, err := os.ReadFile(getTileVersionFileName(tileFileName))
+	if err != nil {
+		return TileVersion{}, false
+	}
+	var version TileVersion
+	err = json.Unmarshal(versionBytes, &version)
+	if err != nil {
+		log.Println(err.Error())
+		return TileVersion{}, false
+	}
+	return version, true
+}
+
+// The version of a cached tile is stored next to it, e.g. classic.json for classic.png
+func getTileVersionFileName(tileFileName string) string {
+	return strings.TrimSuffix(tileFileName, ".png") + ".json"
+}
+
+func ServeTileFromCache(w http.ResponseWriter, tileFileName string) {
+	//Check if file exists and open
+	tileFile, err := os.Open(tileFileName)
+	if err != nil {
+		//File not found, send 404
+		http.Error(w, "File not found.", 404)
+		return
+	}
+
+	_, err = io.Copy(w, tileFile) //'Copy' the file to the client
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = tileFile.Close() //Close after function returns
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Read a tile from the disk cache
+func LoadTileFromFile(tileFileName string) (image.Image, error) {
+	tileFile, err := os.Open(tileFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer tileFile.Close()
+	return png.Decode(tileFile)
+}
+
+// Encode a tile as png
+func EncodeTile(tile image.Image) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := png.Encode(&buffer, tile)
+	return buffer.Bytes(), err
+}
+
+// Store a tile in the disk cache with the version of the data it was drawn from, so that it is served with the
+// same validators as when it was rendered
+func StoreTileInFile(tile image.Image, filename string, version TileVersion) {
+	tileFolderName := filename[:strings.LastIndex(filename, "/")]
+	CreateDirIfNotExist(tileFolderName)
+
+	newImage, err := os.Create(filename)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	err = png.Encode(newImage, tile)
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	err = newImage.Close()
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	versionBytes, err := json.Marshal(version)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	err = os.WriteFile(getTileVersionFileName(filename), versionBytes, 0644)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
@@ -1,176 +1,163 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"github.com/fogleman/gg"
-	"github.com/gorilla/mux"
 	"image"
-	"image/png"
-	"io"
 	"log"
 	"math"
 	"net/http"
-	"net/url"
-	"os"
 	"sort"
-	"strconv"
-	"strings"
 	"time"
 	"ttnmapper-tms/types"
 )
 
-func GetCirclesTile(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-
-	networkId := vars["network_id"]
-	gatewayId, singleGateway := vars["gateway_id"]
-
-	// We've chosen to use mux.NewRouter().UseEncodedPath() which will return the path variables in encoded form.
-	// This is necessary to correctly pass NS_TTS:// (two forward slashes).
-	// Decode now.
-	networkId, _ = url.QueryUnescape(networkId)
-	gatewayId, _ = url.QueryUnescape(gatewayId)
-
-	z, err := strconv.Atoi(vars["z"])
+func (s *TileServer) GetCirclesTile(w http.ResponseWriter, r *http.Request) {
+	tileRequest, err := parseTileRequest(r, ".png")
 	if err != nil {
-		log.Println(w, "Z invalid")
-		http.Error(w, "z invalid", http.StatusBadRequest)
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	networkId, gatewayId := tileRequest.NetworkId, tileRequest.GatewayId
+	z, x, y := tileRequest.Z, tileRequest.X, tileRequest.Y
 
-	x, err := strconv.Atoi(vars["x"])
-	if err != nil {
-		log.Println(w, "X invalid")
-		http.Error(w, "x invalid", http.StatusBadRequest)
+	if tileRequest.Source != "" && z < packetTileMinZoom {
+		http.Error(w, "zoom level not available for packet tiles", http.StatusNotFound)
 		return
 	}
 
-	if strings.HasSuffix(vars["y"], ".png") {
-		vars["y"] = strings.TrimSuffix(vars["y"], ".png")
-	}
-	y, err := strconv.Atoi(vars["y"])
+	style, err := GetRequestTileStyle(r)
 	if err != nil {
-		log.Println(w, "Y invalid")
-		http.Error(w, "y invalid", http.StatusBadRequest)
+		log.Println("Style invalid")
+		http.Error(w, "style invalid", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Circles tile %s - %s: %d/%d/%d\t", networkId, gatewayId, z, x, y)
+	log.Printf("Circles tile %s - %s: %d/%d/%d %s\t", networkId, gatewayId, z, x, y, style.Name)
 
-	tileFileName := ""
-	if singleGateway {
-		tileFileName = fmt.Sprintf("%s/gateway/%s/%s/%d/%d/%d.png", myConfiguration.CacheDirCircles, url.QueryEscape(networkId), url.QueryEscape(gatewayId), z, x, y)
-	} else {
-		tileFileName = fmt.Sprintf("%s/network/%s/%d/%d/%d.png", myConfiguration.CacheDirCircles, url.QueryEscape(networkId), z, x, y)
+	if WriteGatewayBlacklisted(w, s.store, tileRequest) {
+		return
 	}
 
-	tileInCacheOutdated := true
-	tileExistInCache := false
-	if file, err := os.Stat(tileFileName); err == nil {
-		tileExistInCache = true
-
-		modifiedTime := file.ModTime()
+	sinceInstall, err := ApplySinceInstall(s.store, &tileRequest)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if sinceInstall != "" {
+		w.Header().Set("X-Since-Install", sinceInstall)
+	}
 
-		// Check the last modified time of the file to see if the time is still new enough
-		if modifiedTime.Add(GetCacheDurationForZoom(z) * 2).After(time.Now()) {
-			tileInCacheOutdated = false
+	tileFileName := GetCirclesTileFileName(tileRequest, style)
+
+	// Cached tiles are served without querying their data, with the validators of the data they were drawn from
+	if myConfiguration.CacheEnabled {
+		if version, ok := TileInCache(tileFileName, z); ok {
+			if WriteTileValidators(w, r, version, tileFileName) {
+				return
+			}
+			log.Printf("serving from cache\n")
+			//promTmsCirclesCacheCount.Inc()
+			ServeTileFromCache(w, tileFileName)
+			return
 		}
 	}
 
-	//log.Println("Cache enabled: ", myConfiguration.CacheEnabled)
-	//log.Println("Tile in cache: ", tileExistInCache)
-	//log.Println("Tile outdated: ", tileInCacheOutdated)
-	//log.Println("Single gateway: ", singleGateway)
+	// Tiles only change when their data does, so clients can revalidate them without a render
+	xMin, yMin, xMax, yMax := GetZ19TileRangeBuffer(x, y, z, GetCirclesBuffer(z))
+	version, err := GetTileVersion(r.Context(), s.store, tileRequest, xMin, yMin, xMax, yMax)
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if WriteTileValidators(w, r, version, tileFileName) {
+		return
+	}
+
+	log.Printf("generating tile\n")
+	//promTmsCirclesCreateCount.Inc()
+	//tileStart := time.Now()
 
-	// Only cache global tiles, not per gateway tiles
-	if myConfiguration.CacheEnabled && tileExistInCache && !tileInCacheOutdated && !singleGateway {
-		log.Printf("serving from cache\n")
-		//promTmsCirclesCacheCount.Inc()
+	// Concurrent requests for the same tile share one query and render
+	tileBytes, err := s.renderCoalescer.Do(tileFileName, func() ([]byte, error) {
+		ctx, cancel := renderContext(r.Context())
+		defer cancel()
 
-		//Check if file exists and open
-		tileFile, err := os.Open(tileFileName)
+		tile, err := s.RenderCirclesTile(ctx, tileRequest, style)
 		if err != nil {
-			//File not found, send 404
-			http.Error(w, "File not found.", 404)
-			return
+			return nil, err
 		}
 
-		_, err = io.Copy(w, tileFile) //'Copy' the file to the client
-		if err != nil {
-			log.Println(err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		err = tileFile.Close() //Close after function returns
-		if err != nil {
-			log.Println(err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		if myConfiguration.CacheEnabled && tileRequest.CacheOnDemand() {
+			StoreTileInFile(tile, tileFileName, version)
 		}
 
-	} else {
-		log.Printf("generating tile\n")
-		//promTmsCirclesCreateCount.Inc()
-		//tileStart := time.Now()
-
-		// Circles can overlap tiles. Generate a list of z19 tiles in the current tile, with a buffer around this tile.
-		// Z  - buffer for one z19 tile
-		// 19 - 1
-		// 18 - 0.5
-		// 17 - 0.25
-		// 16 - 0.125
-		// 15 - 0.0625
-		// 14 - 0.03125
-		// min circle radius is 6*1.6=9.6
-		// 9.6 / 256 = 0.0375 = min buffer
-		buffer := 1 / math.Pow(2, float64(19-z))
-		if buffer < 0.0375 {
-			buffer = 0.0375
-		}
-		xMin, yMin, xMax, yMax := GetZ19TileRangeBuffer(x, y, z, buffer)
-
-		//log.Println("Selecting data")
-		var samples []types.Sample
-		if singleGateway {
-			samples, err = GetGatewaySamplesInRange(networkId, gatewayId, xMin, yMin, xMax, yMax)
-		} else {
-			samples, err = GetNetworkSamplesInRange(networkId, xMin, yMin, xMax, yMax)
-		}
+		return EncodeTile(tile)
+	})
 
-		// Database error
-		if err != nil {
-			http.Error(w, "database error", http.StatusInternalServerError)
-			return
-		}
+	// Database error
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
 
-		// Sort by RSSI ascending
-		sort.Sort(types.ByRssi(samples))
+	// Set cache headers in the response
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Expires", time.Now().Add(24*time.Hour).Format(http.TimeFormat))
 
-		// Do something with tile data
-		tile := CreateCirclesTile(x, y, z, samples)
-		if myConfiguration.CacheEnabled && !singleGateway {
-			StoreTileInFile(tile, tileFileName)
-		}
+	_, err = w.Write(tileBytes)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
 
-		// Set cache headers in the response
-		w.Header().Set("Cache-Control", "public, max-age=86400")
-		w.Header().Set("Expires", time.Now().Add(24*time.Hour).Format(http.TimeFormat))
-		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	// Prometheus stats
+	//gatewayElapsed := time.Since(tileStart)
+	//promTmsCirclesDuration.Observe(float64(gatewayElapsed.Nanoseconds()) / 1000.0 / 1000.0) //nanoseconds to milliseconds
+}
 
-		err = png.Encode(w, tile)
-		if err != nil {
-			log.Println(err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+// Select the samples in and around a tile and draw them as circles
+func (s *TileServer) RenderCirclesTile(ctx context.Context, tileRequest TileRequest, style TileStyle) (image.Image, error) {
+	z, x, y := tileRequest.Z, tileRequest.X, tileRequest.Y
+
+	// Circles can overlap tiles, so select the samples in a buffer around this tile
+	xMin, yMin, xMax, yMax := GetZ19TileRangeBuffer(x, y, z, GetCirclesBuffer(z))
+
+	//log.Println("Selecting data")
+	samples, err := GetTileSamplesInRange(ctx, s.store, tileRequest, xMin, yMin, xMax, yMax)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort by RSSI ascending
+	sort.Sort(types.ByRssi(samples))
+
+	// Do something with tile data
+	return CreateCirclesTile(x, y, z, tileRequest.Scale, samples, style), nil
+}
 
-		// Prometheus stats
-		//gatewayElapsed := time.Since(tileStart)
-		//promTmsCirclesDuration.Observe(float64(gatewayElapsed.Nanoseconds()) / 1000.0 / 1000.0) //nanoseconds to milliseconds
+// Circles can overlap tiles. Return the buffer in tiles around a tile at zoom z in which circles reach into the tile.
+func GetCirclesBuffer(z int) float64 {
+	// Z  - buffer for one z19 tile
+	// 19 - 1
+	// 18 - 0.5
+	// 17 - 0.25
+	// 16 - 0.125
+	// 15 - 0.0625
+	// 14 - 0.03125
+	// min circle radius is 6*1.6=9.6
+	// 9.6 / 256 = 0.0375 = min buffer
+	buffer := 1 / math.Pow(2, float64(19-z))
+	if buffer < 0.0375 {
+		buffer = 0.0375
 	}
+	return buffer
 }
 
-func CreateCirclesTile(x int, y int, z int, samples []types.Sample) image.Image {
+func CreateCirclesTile(x int, y int, z int, scale int, samples []types.Sample, style TileStyle) image.Image {
 
 	// x, y, z is for outer tile
 	// Draw image for x-1, y-1 to x+2, y+2
@@ -189,38 +176,21 @@ func CreateCirclesTile(x int, y int, z int, samples []types.Sample) image.Image
 	//log.Println("Equivalent radius ", nominalRadius)
 	nominalRadius = math.Max(nominalRadius, 6.0) // minimum is 3 pixels radius
 
-	dc := gg.NewContext(768, 768)
+	// High-DPI tiles are drawn on a larger canvas with everything scaled up
+	tileSize := 256 * scale
+	nominalRadius = nominalRadius * float64(scale)
+
+	dc := gg.NewContext(3*tileSize, 3*tileSize)
 
 	for _, sample := range samples {
 
 		// Add 0.5 because the tile index is the NW corner, but we want to draw it in the middle of the z19 tile
-		pixelY := ((float64(sample.Y-yMin) + 0.5) / yWidth) * 768.0 // pixels from top
-		pixelX := ((float64(sample.X-xMin) + 0.5) / xWidth) * 768.0 // pixels from left
-
-		signal := sample.MaxBucketIndex
-		if signal == 12 {
-			// Out of range, do not draw
-			dc.DrawCircle(pixelX, pixelY, nominalRadius*1.6)
-			dc.SetRGB(0, 0, 0)
-		} else if signal >= 5 { //11..5
-			dc.DrawCircle(pixelX, pixelY, nominalRadius*1.5)
-			dc.SetRGB(0, 0, 1)
-		} else if signal == 4 {
-			dc.DrawCircle(pixelX, pixelY, nominalRadius*1.4)
-			dc.SetRGB(0, 1, 1)
-		} else if signal == 3 {
-			dc.DrawCircle(pixelX, pixelY, nominalRadius*1.3)
-			dc.SetRGB(0, 1, 0)
-		} else if signal == 2 {
-			dc.DrawCircle(pixelX, pixelY, nominalRadius*1.2)
-			dc.SetRGB(1, 1, 0)
-		} else if signal == 1 {
-			dc.DrawCircle(pixelX, pixelY, nominalRadius*1.1)
-			dc.SetRGB(1, 0.5, 0)
-		} else {
-			dc.DrawCircle(pixelX, pixelY, nominalRadius)
-			dc.SetRGB(1, 0, 0)
-		}
+		pixelY := ((float64(sample.Y-yMin) + 0.5) / yWidth) * float64(3*tileSize) // pixels from top
+		pixelX := ((float64(sample.X-xMin) + 0.5) / xWidth) * float64(3*tileSize) // pixels from left
+
+		bucketStyle := style.Buckets[sample.MaxBucketIndex]
+		dc.DrawCircle(pixelX, pixelY, nominalRadius*bucketStyle.RadiusFactor)
+		dc.SetRGBA(bucketStyle.R, bucketStyle.G, bucketStyle.B, bucketStyle.Alpha)
 		dc.Fill()
 	}
 
@@ -229,27 +199,7 @@ func CreateCirclesTile(x int, y int, z int, samples []types.Sample) image.Image
 	// Crop out tile
 	tile := srcImage.(interface {
 		SubImage(r image.Rectangle) image.Image
-	}).SubImage(image.Rect(256, 256, 2*256, 2*256))
+	}).SubImage(image.Rect(tileSize, tileSize, 2*tileSize, 2*tileSize))
 
 	return tile
 }
-
-func StoreTileInFile(tile image.Image, filename string) {
-	tileFolderName := filename[:strings.LastIndex(filename, "/")]
-	CreateDirIfNotExist(tileFolderName)
-
-	newImage, err := os.Create(filename)
-	if err != nil {
-		log.Println(err.Error())
-	}
-
-	err = png.Encode(newImage, tile)
-	if err != nil {
-		log.Println(err.Error())
-	}
-
-	err = newImage.Close()
-	if err != nil {
-		log.Println(err.Error())
-	}
-}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func assertPixel(t *testing.T, tile image.Image, x int, y int, expected color.RGBA) {
+	r, g, b, a := tile.At(tile.Bounds().Min.X+x, tile.Bounds().Min.Y+y).RGBA()
+	actual := color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8), A: uint8(a >> 8)}
+	if actual != expected {
+		t.Errorf("pixel %d,%d: expected %v, got %v", x, y, expected, actual)
+	}
+}
+
+func TestGetCirclesTile(t *testing.T) {
+	cacheEnabled := myConfiguration.CacheEnabled
+	defer func() { myConfiguration.CacheEnabled = cacheEnabled }()
+	myConfiguration.CacheEnabled = false
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	tile := getTestResponse(t, server, "/circles/network/thethingsnetwork.org/14/9050/9835.png", png.Decode)
+	if tile.Bounds().Dx() != 256 || tile.Bounds().Dy() != 256 {
+		t.Fatalf("unexpected tile size %v", tile.Bounds())
+	}
+	// Cell 289610,314730 is drawn in the middle of z19 cell 10,10 of this tile
+	assertPixel(t, tile, 84, 84, color.RGBA{R: 255, A: 255})
+	assertPixel(t, tile, 164, 164, color.RGBA{R: 255, G: 255, A: 255})
+	// Offline gateway
+	assertPixel(t, tile, 100, 100, color.RGBA{})
+
+	tile = getTestResponse(t, server, "/circles/gateway/thethingsnetwork.org/eui-60c5a8fffe761551/14/9050/9835.png?since_install=false", png.Decode)
+	assertPixel(t, tile, 84, 84, color.RGBA{R: 255, A: 255})
+
+	// Network IDs containing slashes are passed url encoded
+	tile = getTestResponse(t, server, "/circles/network/NS_TTS_V3%3A%2F%2Fttn%40000013/14/9050/9835.png", png.Decode)
+	assertPixel(t, tile, 124, 124, color.RGBA{B: 255, A: 255})
+	assertPixel(t, tile, 84, 84, color.RGBA{})
+}
+
+func TestGetCirclesTileIncludeOffline(t *testing.T) {
+	cacheEnabled := myConfiguration.CacheEnabled
+	defer func() { myConfiguration.CacheEnabled = cacheEnabled }()
+	myConfiguration.CacheEnabled = false
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	tile := getTestResponse(t, server, "/circles/network/thethingsnetwork.org/14/9050/9835.png?include_offline=true", png.Decode)
+	assertPixel(t, tile, 100, 100, color.RGBA{R: 255, G: 127, A: 255})
+
+	resp, err := http.Get(server.URL + "/circles/network/thethingsnetwork.org/14/9050/9835.png?include_offline=sometimes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestGetCirclesTileNetworks(t *testing.T) {
+	cacheEnabled, cacheDirCircles := myConfiguration.CacheEnabled, myConfiguration.CacheDirCircles
+	defer func() { myConfiguration.CacheEnabled, myConfiguration.CacheDirCircles = cacheEnabled, cacheDirCircles }()
+	myConfiguration.CacheEnabled = true
+	myConfiguration.CacheDirCircles = t.TempDir()
+
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	// The coverage of both networks is drawn on one tile
+	tile := getTestResponse(t, server, "/circles/network/thethingsnetwork.org/14/9050/9835.png?networks="+url.QueryEscape(testV3NetworkId), png.Decode)
+	assertPixel(t, tile, 84, 84, color.RGBA{R: 255, A: 255})
+	assertPixel(t, tile, 124, 124, color.RGBA{B: 255, A: 255})
+
+	// Tiles combining networks are not cached, as they are not invalidated when one of the networks changes
+	entries, err := os.ReadDir(myConfiguration.CacheDirCircles)
+	if err == nil && len(entries) > 0 {
+		t.Errorf("expected no cached tiles, got %v", entries)
+	}
+
+	resp, err := http.Get(server.URL + "/circles/gateway/thethingsnetwork.org/eui-60c5a8fffe761551/14/9050/9835.png?networks=" + url.QueryEscape(testV3NetworkId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestGetCirclesTileInvalidCoordinates(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/circles/network/thethingsnetwork.org/14/abc/9835.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestGetGatewayTileBlacklisted(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	for _, path := range []string{
+		"/circles/gateway/thethingsnetwork.org/" + testBlacklistGateway + "/14/9050/9835.png",
+		"/blocks/gateway/thethingsnetwork.org/" + testBlacklistGateway + "/14/9050/9835.png",
+		"/circles/packets/gateway/thethingsnetwork.org/" + testBlacklistGateway + "/14/9050/9835.png",
+		"/mvt/gateway/thethingsnetwork.org/" + testBlacklistGateway + "/14/9050/9835.pbf",
+	} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: expected status %d, got %d", path, http.StatusNotFound, resp.StatusCode)
+		}
+	}
+}
+
+func TestGetCirclesTileStyle(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	tile := getTestResponse(t, server, "/circles/network/thethingsnetwork.org/14/9050/9835.png?style=grayscale", png.Decode)
+	assertPixel(t, tile, 84, 84, color.RGBA{R: 25, G: 25, B: 25, A: 255})
+
+	resp, err := http.Get(server.URL + "/circles/network/thethingsnetwork.org/14/9050/9835.png?style=unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestGetCirclesTileHighDpi(t *testing.T) {
+	cacheEnabled, cacheDirCircles := myConfiguration.CacheEnabled, myConfiguration.CacheDirCircles
+	defer func() { myConfiguration.CacheEnabled, myConfiguration.CacheDirCircles = cacheEnabled, cacheDirCircles }()
+	myConfiguration.CacheEnabled = true
+	myConfiguration.CacheDirCircles = t.TempDir()
+
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	tile := getTestResponse(t, server, "/circles/network/thethingsnetwork.org/14/9050/9835@2x.png", png.Decode)
+	if tile.Bounds().Dx() != 512 || tile.Bounds().Dy() != 512 {
+		t.Fatalf("unexpected tile size %v", tile.Bounds())
+	}
+	assertPixel(t, tile, 168, 168, color.RGBA{R: 255, A: 255})
+	// The radius is scaled too, 6px becomes 12px
+	assertPixel(t, tile, 178, 168, color.RGBA{R: 255, A: 255})
+	assertPixel(t, tile, 184, 168, color.RGBA{})
+
+	_, err := os.Stat(myConfiguration.CacheDirCircles + "/network/thethingsnetwork.org/14/9050/9835/classic@2x.png")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetCirclesTileConditional(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+	tileUrl := server.URL + "/circles/gateway/thethingsnetwork.org/eui-60c5a8fffe761551/14/9050/9835.png?since_install=false"
+
+	resp, err := http.Get(tileUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// The newest cell of the gateway in the tile was updated 2021-05-03 08:00
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+	if resp.Header.Get("Last-Modified") != "Mon, 03 May 2021 08:00:00 GMT" {
+		t.Errorf("unexpected Last-Modified %s", resp.Header.Get("Last-Modified"))
+	}
+
+	for _, test := range []struct {
+		header   string
+		value    string
+		expected int
+	}{
+		{"If-None-Match", etag, http.StatusNotModified},
+		{"If-None-Match", `"other", ` + etag, http.StatusNotModified},
+		{"If-None-Match", `"other"`, http.StatusOK},
+		{"If-Modified-Since", "Mon, 03 May 2021 08:00:00 GMT", http.StatusNotModified},
+		{"If-Modified-Since", "Mon, 03 May 2021 07:59:59 GMT", http.StatusOK},
+	} {
+		req, _ := http.NewRequest("GET", tileUrl, nil)
+		req.Header.Set(test.header, test.value)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.expected {
+			t.Errorf("%s: %s: expected status %d, got %d", test.header, test.value, test.expected, resp.StatusCode)
+		}
+	}
+
+	// Another style is another tile
+	resp, err = http.Get(tileUrl + "&style=grayscale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("ETag") == etag {
+		t.Error("expected a different ETag for another style")
+	}
+}
+
+func TestGetCirclesTileConditionalGatewayStatus(t *testing.T) {
+	store := newTestStore(t)
+	server := httptest.NewServer(NewTileServer(store).NewRouter())
+	defer server.Close()
+	tileUrl := server.URL + "/circles/network/thethingsnetwork.org/14/9050/9835.png"
+
+	// The newest cell of the online gateway in the tile was updated 2021-05-03 08:00
+	resp, err := http.Get(tileUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if resp.Header.Get("Last-Modified") != "Mon, 03 May 2021 08:00:00 GMT" {
+		t.Errorf("unexpected Last-Modified %s", resp.Header.Get("Last-Modified"))
+	}
+
+	req, _ := http.NewRequest("GET", tileUrl, nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected status %d, got %d", http.StatusNotModified, resp.StatusCode)
+	}
+
+	// A gateway going offline changes the tile without updating its grid cells
+	for i := range store.Gateways {
+		if store.Gateways[i].GatewayId == "eui-60c5a8fffe761551" {
+			store.Gateways[i].LastHeard = time.Now().Add(-time.Duration(myConfiguration.GatewayOfflineHours+1) * time.Hour)
+		}
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Errorf("expected status %d with a new ETag, got %d with %s", http.StatusOK, resp.StatusCode, resp.Header.Get("ETag"))
+	}
+}
+
+func TestGetCirclesTileConditionalCached(t *testing.T) {
+	cacheEnabled, cacheDirCircles := myConfiguration.CacheEnabled, myConfiguration.CacheDirCircles
+	defer func() { myConfiguration.CacheEnabled, myConfiguration.CacheDirCircles = cacheEnabled, cacheDirCircles }()
+	myConfiguration.CacheEnabled = true
+	myConfiguration.CacheDirCircles = t.TempDir()
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+	tileUrl := server.URL + "/circles/network/thethingsnetwork.org/14/9050/9835.png"
+
+	rendered, err := http.Get(tileUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered.Body.Close()
+
+	// Replace the cached tile, to see that the next response is served from the cache
+	err = os.WriteFile(myConfiguration.CacheDirCircles+"/network/thethingsnetwork.org/14/9050/9835/classic.png", testBlankTile(t), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cached tiles have the same validators as when they were rendered
+	cached, err := http.Get(tileUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cached.Body.Close()
+	tile, err := png.Decode(cached.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPixel(t, tile, 84, 84, color.RGBA{})
+	for _, header := range []string{"ETag", "Last-Modified"} {
+		if cached.Header.Get(header) != rendered.Header.Get(header) {
+			t.Errorf("%s: expected %s from the cache, got %s", header, rendered.Header.Get(header), cached.Header.Get(header))
+		}
+	}
+
+	req, _ := http.NewRequest("GET", tileUrl, nil)
+	req.Header.Set("If-None-Match", rendered.Header.Get("ETag"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected status %d, got %d", http.StatusNotModified, resp.StatusCode)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Bump when the rendering of tiles changes, so that clients do not keep tiles drawn by an older version
+const tileRenderVersion = 1
+
+// TileVersion identifies the data a tile is drawn from, to derive its ETag and Last-Modified from
+type TileVersion struct {
+	// The newest LastUpdated of the grid cells or packets the tile is drawn from
+	LastUpdated time.Time
+	// A hash of the antennas shown on a network tile. Gateways going offline or being blacklisted change which
+	// antennas are shown without updating any grid cells.
+	GatewayStatus uint64
+}
+
+// Return the version of the data a tile is drawn from. Packets are aggregated into grid cells when they are
+// received, except for the tiles that are only drawn from packets.
+func GetTileVersion(ctx context.Context, store SampleStore, tileRequest TileRequest, xMin int, yMin int, xMax int, yMax int) (TileVersion, error) {
+	if tileRequest.PacketsOnly() {
+		lastUpdated, err := store.GetPacketLastUpdatedInRange(ctx, tileRequest.GetPacketFilter(), xMin, yMin, xMax, yMax)
+		return TileVersion{LastUpdated: lastUpdated}, err
+	}
+	if tileRequest.SingleGateway {
+		lastUpdated, err := store.GetGatewayLastUpdatedInRange(tileRequest.NetworkId, tileRequest.GatewayId, xMin, yMin, xMax, yMax)
+		return TileVersion{LastUpdated: lastUpdated}, err
+	}
+
+	// A tile combining several networks changes when any of them does
+	antennasLastUpdated := map[uint]time.Time{}
+	for _, networkId := range tileRequest.GetNetworkIds() {
+		networkLastUpdated, err := store.GetNetworkAntennasLastUpdatedInRange(networkId, xMin, yMin, xMax, yMax)
+		if err != nil {
+			return TileVersion{}, err
+		}
+		maps.Copy(antennasLastUpdated, networkLastUpdated)
+	}
+
+	antennaIds := slices.Sorted(maps.Keys(antennasLastUpdated))
+	statuses, err := store.GetAntennaStatuses(antennaIds)
+	if err != nil {
+		return TileVersion{}, err
+	}
+
+	// Only the antennas the tile shows count, like visibleGridCells selects them
+	var version TileVersion
+	selection := tileRequest.AntennaSelection()
+	hash := fnv.New64a()
+	for _, antennaId := range antennaIds {
+		status, ok := statuses[antennaId]
+		if !ok || !antennaVisible(status, selection) {
+			continue
+		}
+		if selection.SinceInstall && antennasLastUpdated[antennaId].Before(status.InstalledAt) {
+			continue
+		}
+
+		_, _ = fmt.Fprintf(hash, "%d/", antennaId)
+		if selection.SinceInstall {
+			_, _ = fmt.Fprintf(hash, "%d/", status.InstalledAt.Unix())
+		}
+		if antennasLastUpdated[antennaId].After(version.LastUpdated) {
+			version.LastUpdated = antennasLastUpdated[antennaId]
+		}
+	}
+	version.GatewayStatus = hash.Sum64()
+	return version, nil
+}
+
+// Return the range of z19 cells a circles or blocks tile is drawn from, for the tiles that are stored without
+// going through their handler
+func getLayerTileRange(tileRequest TileRequest, blocks bool) (xMin int, yMin int, xMax int, yMax int) {
+	buffer := GetCirclesBuffer(tileRequest.Z)
+	if blocks {
+		buffer = 0
+	}
+	return GetZ19TileRangeBuffer(tileRequest.X, tileRequest.Y, tileRequest.Z, buffer)
+}
+
+// Tiles of a blacklisted gateway are not served, not even from the cache. Sends a 404 Not Found
+// or a database error and returns true if the tile should not be served.
+func WriteGatewayBlacklisted(w http.ResponseWriter, store SampleStore, tileRequest TileRequest) bool {
+	if !tileRequest.SingleGateway {
+		return false
+	}
+
+	blacklisted, err := GetGatewayBlacklisted(store, tileRequest.NetworkId, tileRequest.GatewayId)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return true
+	}
+	if blacklisted {
+		http.Error(w, "gateway blacklisted", http.StatusNotFound)
+		return true
+	}
+	return false
+}
+
+// Set the ETag and Last-Modified headers of a tile from the version of its data and the variant it is drawn in,
+// like the layer, style and scale. If the client already has this version of the tile a 304 Not Modified is sent
+// and true is returned, so that the tile does not need to be rendered.
+func WriteTileValidators(w http.ResponseWriter, r *http.Request, version TileVersion, variant string) bool {
+	// Last-Modified has a resolution of seconds
+	lastModified := version.LastUpdated.UTC().Truncate(time.Second)
+
+	hash := fnv.New64a()
+	_, _ = fmt.Fprintf(hash, "%d/%s/%d/%x", tileRenderVersion, variant, lastModified.Unix(), version.GatewayStatus)
+	etag := fmt.Sprintf(`"%x"`, hash.Sum64())
+
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etagMatches(ifNoneMatch, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+		return false
+	}
+
+	if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err == nil && !lastModified.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check if an If-None-Match header lists the etag, using the weak comparison
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/fogleman/gg"
+	"image"
+	"log"
+	"net/http"
+	"time"
+	"ttnmapper-tms/types"
+)
+
+// Radius of a gateway marker on a 256px tile, including its outline
+const gatewayMarkerRadius = 6.0
+
+func (s *TileServer) GetGatewaysTile(w http.ResponseWriter, r *http.Request) {
+	tileRequest, err := parseTilePath(r, ".png")
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	z, x, y := tileRequest.Z, tileRequest.X, tileRequest.Y
+
+	log.Printf("Gateways tile %s: %d/%d/%d\t", tileRequest.NetworkId, z, x, y)
+
+	// Also select the gateways just outside the tile whose markers reach into it
+	boundingBox := TileBoundingBox(x, y, z, gatewayMarkerRadius/256)
+	gateways, err := s.store.GetGatewaysInBoundingBox(tileRequest.NetworkId, boundingBox)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	tileBytes, err := EncodeTile(CreateGatewaysTile(x, y, z, tileRequest.Scale, gateways))
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Gateways go offline without their data changing, so do not let clients keep the tile long
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("Expires", time.Now().Add(5*time.Minute).Format(http.TimeFormat))
+
+	_, err = w.Write(tileBytes)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Draw a marker for every gateway, green when it is online and grey when it is offline
+func CreateGatewaysTile(x int, y int, z int, scale int, gateways []types.Gateway) image.Image {
+	tileSize := 256.0 * float64(scale)
+	radius := gatewayMarkerRadius * float64(scale)
+
+	dc := gg.NewContext(int(tileSize), int(tileSize))
+
+	// Draw the online gateways last, so that they are on top of offline gateways at the same location
+	for _, online := range []bool{false, true} {
+		for _, gateway := range gateways {
+			if LastHeardOnline(gateway.LastHeard) != online {
+				continue
+			}
+
+			pixelX := (LonToTileX(gateway.Longitude, z) - float64(x)) * tileSize
+			pixelY := (LatToTileY(gateway.Latitude, z) - float64(y)) * tileSize
+
+			dc.DrawCircle(pixelX, pixelY, radius)
+			dc.SetRGB(1, 1, 1)
+			dc.Fill()
+
+			dc.DrawCircle(pixelX, pixelY, radius-1.5*float64(scale))
+			if online {
+				dc.SetRGB(0.1, 0.6, 0.1)
+			} else {
+				dc.SetRGB(0.5, 0.5, 0.5)
+			}
+			dc.Fill()
+		}
+	}
+
+	return dc.Image()
+}
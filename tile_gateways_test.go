@@ -0,0 +1,35 @@
+package main
+
+import (
+	"image/color"
+	"image/png"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetGatewaysTile(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	tile := getTestResponse(t, server, "/gateways/network/thethingsnetwork.org/14/9050/9835.png", png.Decode)
+	if tile.Bounds().Dx() != 256 || tile.Bounds().Dy() != 256 {
+		t.Fatalf("unexpected tile size %v", tile.Bounds())
+	}
+
+	// Online gateway in green, offline gateway in grey at its forced location
+	assertPixel(t, tile, 215, 167, color.RGBA{R: 25, G: 153, B: 25, A: 255})
+	assertPixel(t, tile, 86, 124, color.RGBA{R: 127, G: 127, B: 127, A: 255})
+	assertPixel(t, tile, 191, 159, color.RGBA{})
+
+	// The gateway forced to 0,0 is left out
+	assertPixel(t, tile, 145, 110, color.RGBA{})
+
+	// Away from the gateways the tile is transparent
+	assertPixel(t, tile, 40, 40, color.RGBA{})
+
+	retina := getTestResponse(t, server, "/gateways/network/thethingsnetwork.org/14/9050/9835@2x.png", png.Decode)
+	if retina.Bounds().Dx() != 512 {
+		t.Fatalf("unexpected retina tile size %v", retina.Bounds())
+	}
+	assertPixel(t, retina, 431, 335, color.RGBA{R: 25, G: 153, B: 25, A: 255})
+}
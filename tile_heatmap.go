@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fogleman/gg"
+	"image"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+	"ttnmapper-tms/types"
+)
+
+// Cells with this many measurements or more get the last colour of the gradient
+const heatmapMaxCount = 10000
+
+// heatmapGradientStop is a colour stop of the heatmap gradient, at position T between 0 for a single measurement
+// and 1 for heatmapMaxCount measurements
+type heatmapGradientStop struct {
+	T       float64
+	R, G, B float64
+}
+
+// Blue for cells with a single measurement, through cyan, green and yellow, to red for the most mapped cells
+var heatmapGradient = []heatmapGradientStop{
+	{0, 0, 0, 1},
+	{0.25, 0, 1, 1},
+	{0.5, 0, 1, 0},
+	{0.75, 1, 1, 0},
+	{1, 1, 0, 0},
+}
+
+func (s *TileServer) GetHeatmapTile(w http.ResponseWriter, r *http.Request) {
+	tileRequest, err := parseTileRequest(r, ".png")
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	z, x, y := tileRequest.Z, tileRequest.X, tileRequest.Y
+
+	// Heatmaps count all measurements of a cell, whatever its aggregation
+	tileRequest.Aggregation = CellAggregation{}
+
+	log.Printf("Heatmap tile %s: %d/%d/%d\t", tileRequest.NetworkId, z, x, y)
+
+	sinceInstall, err := ApplySinceInstall(s.store, &tileRequest)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if sinceInstall != "" {
+		w.Header().Set("X-Since-Install", sinceInstall)
+	}
+
+	tileFileName := GetHeatmapTileFileName(tileRequest)
+
+	// Cached tiles are served without querying their data, with the validators of the data they were drawn from
+	if myConfiguration.CacheEnabled {
+		if version, ok := TileInCache(tileFileName, z); ok {
+			if WriteTileValidators(w, r, version, tileFileName) {
+				return
+			}
+			log.Printf("serving from cache\n")
+			ServeTileFromCache(w, tileFileName)
+			return
+		}
+	}
+
+	// Tiles only change when their data does, so clients can revalidate them without a render
+	xMin, yMin, xMax, yMax := GetZ19TileRangeBuffer(x, y, z, 0)
+	version, err := GetTileVersion(r.Context(), s.store, tileRequest, xMin, yMin, xMax, yMax)
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if WriteTileValidators(w, r, version, tileFileName) {
+		return
+	}
+
+	log.Printf("generating new tile\n")
+
+	// Concurrent requests for the same tile share one query and render
+	tileBytes, err := s.renderCoalescer.Do(tileFileName, func() ([]byte, error) {
+		tile, err := s.RenderHeatmapTile(tileRequest)
+		if err != nil {
+			return nil, err
+		}
+
+		if myConfiguration.CacheEnabled && tileRequest.CacheOnDemand() {
+			StoreTileInFile(tile, tileFileName, version)
+		}
+
+		return EncodeTile(tile)
+	})
+
+	// Database error
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Set cache headers in the response
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Expires", time.Now().Add(24*time.Hour).Format(http.TimeFormat))
+
+	_, err = w.Write(tileBytes)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+}
+
+// Select the grid cells in a tile and draw them coloured by their number of measurements
+func (s *TileServer) RenderHeatmapTile(tileRequest TileRequest) (image.Image, error) {
+	z, x, y := tileRequest.Z, tileRequest.X, tileRequest.Y
+
+	// Like blocks, heatmap cells do not overlap tiles
+	xMin, yMin, xMax, yMax := GetZ19TileRangeBuffer(x, y, z, 0)
+
+	cells, err := GetNetworkMergedCellsInRange(s.store, tileRequest.GetNetworkIds(), xMin, yMin, xMax, yMax, tileRequest.Window, tileRequest.AntennaSelection())
+	if err != nil {
+		return nil, err
+	}
+
+	return CreateHeatmapTile(x, y, z, tileRequest.Scale, cells), nil
+}
+
+// Draw grid cells as blocks coloured by the total number of measurements in them. At low zooms where
+// many z19 cells fall in the same block, the block is coloured by the sum of those cells.
+func CreateHeatmapTile(x int, y int, z int, scale int, cells []types.MergedGridCell) image.Image {
+	xMin, yMin, xMax, yMax := GetZ19TileRangeBuffer(x, y, z, 0)
+	xWidth := float64(xMax - xMin)
+	yWidth := float64(yMax - yMin)
+
+	// The same block size as the blocks layer: one z19 cell, but at least 8 pixels
+	blockSize := math.Max(256.0/math.Pow(2, float64(19-z)), 8.0)
+	tileSize := 256.0 * float64(scale)
+	blockSize = blockSize * float64(scale)
+
+	counts := map[image.Point]uint{}
+	for _, cell := range cells {
+		pixelX := math.Floor(float64(cell.X-xMin)/xWidth*tileSize/blockSize) * blockSize
+		pixelY := math.Floor(float64(cell.Y-yMin)/yWidth*tileSize/blockSize) * blockSize
+		counts[image.Point{X: int(pixelX), Y: int(pixelY)}] += gridCellMeasurementCount(cell.GridCell)
+	}
+
+	// Draw the busiest blocks last so that they stay on top where blocks touch
+	blocks := make([]image.Point, 0, len(counts))
+	for block, count := range counts {
+		if count > 0 {
+			blocks = append(blocks, block)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return counts[blocks[i]] < counts[blocks[j]]
+	})
+
+	dc := gg.NewContext(int(tileSize), int(tileSize))
+	for _, block := range blocks {
+		r, g, b := GetHeatmapColour(counts[block])
+		dc.DrawRectangle(float64(block.X), float64(block.Y), blockSize, blockSize)
+		dc.SetRGBA(r, g, b, 0.8)
+		dc.Fill()
+	}
+
+	return dc.Image()
+}
+
+// The total number of measurements in a grid cell, including those without signal
+func gridCellMeasurementCount(gridCell types.GridCell) uint {
+	var total uint
+	for _, count := range gridCellBuckets(gridCell) {
+		total += count
+	}
+	return total
+}
+
+// Return the colour of a measurement count, on a log scale from 1 to heatmapMaxCount
+func GetHeatmapColour(count uint) (float64, float64, float64) {
+	t := 0.0
+	if count > 1 {
+		t = math.Min(math.Log10(float64(count))/math.Log10(heatmapMaxCount), 1)
+	}
+	return heatmapGradientAt(t)
+}
+
+// Interpolate the gradient linearly between its stops
+func heatmapGradientAt(t float64) (float64, float64, float64) {
+	for i := 1; i < len(heatmapGradient); i++ {
+		stop := heatmapGradient[i]
+		if t <= stop.T {
+			previous := heatmapGradient[i-1]
+			f := (t - previous.T) / (stop.T - previous.T)
+			return previous.R + f*(stop.R-previous.R), previous.G + f*(stop.G-previous.G), previous.B + f*(stop.B-previous.B)
+		}
+	}
+	last := heatmapGradient[len(heatmapGradient)-1]
+	return last.R, last.G, last.B
+}
+
+// Serve a png legend of the heatmap gradient with the measurement counts at every power of ten
+func GetHeatmapLegend(w http.ResponseWriter, r *http.Request) {
+	legendBytes, err := EncodeTile(CreateHeatmapLegend())
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	_, err = w.Write(legendBytes)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func CreateHeatmapLegend() image.Image {
+	const width, height = 256, 40
+	const margin, barHeight = 24, 16
+
+	dc := gg.NewContext(width, height)
+	dc.SetRGBA(1, 1, 1, 0.8)
+	dc.Clear()
+
+	barWidth := float64(width - 2*margin)
+	for i := 0; i < int(barWidth); i++ {
+		r, g, b := heatmapGradientAt(float64(i) / (barWidth - 1))
+		dc.SetRGB(r, g, b)
+		dc.DrawRectangle(float64(margin+i), 4, 1, barHeight)
+		dc.Fill()
+	}
+
+	dc.SetRGB(0, 0, 0)
+	maxPower := int(math.Log10(heatmapMaxCount))
+	for power := 0; power <= maxPower; power++ {
+		label := fmt.Sprintf("%d", int(math.Pow10(power)))
+		if power == maxPower {
+			label += "+"
+		}
+		labelX := margin + barWidth*float64(power)/float64(maxPower)
+		dc.DrawLine(labelX, 4+barHeight, labelX, 4+barHeight+3)
+		dc.Stroke()
+		dc.DrawStringAnchored(label, labelX, height-6, 0.5, 0)
+	}
+
+	return dc.Image()
+}
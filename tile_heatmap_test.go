@@ -0,0 +1,49 @@
+package main
+
+import (
+	"image/color"
+	"image/png"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetHeatmapTile(t *testing.T) {
+	cacheDirHeatmap := myConfiguration.CacheDirHeatmap
+	defer func() { myConfiguration.CacheDirHeatmap = cacheDirHeatmap }()
+	myConfiguration.CacheDirHeatmap = t.TempDir()
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	tile := getTestResponse(t, server, "/heatmap/network/thethingsnetwork.org/14/9050/9835.png", png.Decode)
+	if tile.Bounds().Dx() != 256 || tile.Bounds().Dy() != 256 {
+		t.Fatalf("unexpected tile size %v", tile.Bounds())
+	}
+	// Cell 289610,314730 has 9 measurements from two antennas, cell 289620,314740 has 5
+	assertPixel(t, tile, 80, 80, color.RGBA{G: 195, B: 204, A: 204})
+	assertPixel(t, tile, 160, 160, color.RGBA{G: 142, B: 204, A: 204})
+	assertPixel(t, tile, 88, 88, color.RGBA{})
+	// Offline gateway
+	assertPixel(t, tile, 96, 96, color.RGBA{})
+
+	tile = getTestResponse(t, server, "/heatmap/legend.png", png.Decode)
+	if tile.Bounds().Dx() != 256 {
+		t.Errorf("unexpected legend size %v", tile.Bounds())
+	}
+}
+
+func TestGetHeatmapColour(t *testing.T) {
+	for _, test := range []struct {
+		count    uint
+		expected [3]float64
+	}{
+		{1, [3]float64{0, 0, 1}},
+		{100, [3]float64{0, 1, 0}},
+		{10000, [3]float64{1, 0, 0}},
+		{1000000, [3]float64{1, 0, 0}},
+	} {
+		r, g, b := GetHeatmapColour(test.count)
+		if [3]float64{r, g, b} != test.expected {
+			t.Errorf("%d: expected %v, got %v", test.count, test.expected, [3]float64{r, g, b})
+		}
+	}
+}
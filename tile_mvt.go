@@ -0,0 +1,185 @@
+package main
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+	"log"
+	"math"
+	"net/http"
+	"time"
+	"ttnmapper-tms/types"
+)
+
+// Mapbox Vector Tile constants, see https://github.com/mapbox/vector-tile-spec/blob/master/2.1/vector_tile.proto
+const (
+	mvtExtent       = 4096
+	mvtLayerName    = "coverage"
+	mvtGeomPolygon  = 3
+	mvtCmdMoveTo    = 1
+	mvtCmdLineTo    = 2
+	mvtCmdClosePath = 7
+)
+
+// Attribute keys of every feature, the bucket counts followed by the max bucket and antenna count
+var mvtKeys = append(bucketNames[:], "max_bucket", "antenna_count")
+
+func (s *TileServer) GetMvtTile(w http.ResponseWriter, r *http.Request) {
+	tileRequest, err := parseTileRequest(r, ".pbf")
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	z, x, y := tileRequest.Z, tileRequest.X, tileRequest.Y
+
+	// Features carry the counts of all buckets, so they are not aggregated
+	tileRequest.Aggregation = CellAggregation{}
+
+	log.Printf("MVT tile %s - %s: %d/%d/%d\t", tileRequest.NetworkId, tileRequest.GatewayId, z, x, y)
+
+	if WriteGatewayBlacklisted(w, s.store, tileRequest) {
+		return
+	}
+
+	sinceInstall, err := ApplySinceInstall(s.store, &tileRequest)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if sinceInstall != "" {
+		w.Header().Set("X-Since-Install", sinceInstall)
+	}
+
+	// Polygons do not overlap the tile edges, so only select the cells inside this tile
+	xMin, yMin, xMax, yMax := GetZ19TileRangeBuffer(x, y, z, 0)
+
+	version, err := GetTileVersion(r.Context(), s.store, tileRequest, xMin, yMin, xMax-1, yMax-1)
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if WriteTileValidators(w, r, version, GetTileVariant(tileRequest, "mvt")) {
+		return
+	}
+
+	var cells []types.MergedGridCell
+	if tileRequest.SingleGateway {
+		cells, err = GetGatewayMergedCellsInRange(s.store, tileRequest.NetworkId, tileRequest.GatewayId, xMin, yMin, xMax-1, yMax-1, tileRequest.Window)
+	} else {
+		cells, err = GetNetworkMergedCellsInRange(s.store, tileRequest.GetNetworkIds(), xMin, yMin, xMax-1, yMax-1, tileRequest.Window, tileRequest.AntennaSelection())
+	}
+
+	// Database error
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	tile := CreateMvtTile(x, y, z, cells)
+
+	// Set cache headers in the response
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Expires", time.Now().Add(24*time.Hour).Format(http.TimeFormat))
+
+	_, err = w.Write(tile)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Encode the cells as square polygons in a single layer vector tile
+func CreateMvtTile(x int, y int, z int, cells []types.MergedGridCell) []byte {
+	xMin, yMin, xMax, _ := GetZ19TileRangeBuffer(x, y, z, 0)
+
+	// Number of tile units per z19 cell. At low zooms a cell is smaller than one unit.
+	cellSize := float64(mvtExtent) / float64(xMax-xMin)
+
+	var layer []byte
+	layer = protowire.AppendTag(layer, 15, protowire.VarintType) // version
+	layer = protowire.AppendVarint(layer, 2)
+	layer = protowire.AppendTag(layer, 1, protowire.BytesType) // name
+	layer = protowire.AppendString(layer, mvtLayerName)
+
+	// All attribute values are counts, stored once and referenced by index
+	var values []uint64
+	valueIndexes := map[uint64]uint64{}
+	valueIndex := func(value uint64) uint64 {
+		if i, ok := valueIndexes[value]; ok {
+			return i
+		}
+		valueIndexes[value] = uint64(len(values))
+		values = append(values, value)
+		return valueIndexes[value]
+	}
+
+	for _, cell := range cells {
+		x0 := int64(math.Floor(float64(cell.X-xMin) * cellSize))
+		y0 := int64(math.Floor(float64(cell.Y-yMin) * cellSize))
+		x1 := int64(math.Floor(float64(cell.X-xMin+1) * cellSize))
+		y1 := int64(math.Floor(float64(cell.Y-yMin+1) * cellSize))
+		x1 = max(x1, x0+1)
+		y1 = max(y1, y0+1)
+
+		var tags []byte
+		for i, count := range gridCellBuckets(cell.GridCell) {
+			tags = protowire.AppendVarint(tags, uint64(i))
+			tags = protowire.AppendVarint(tags, valueIndex(uint64(count)))
+		}
+		tags = protowire.AppendVarint(tags, 13)
+		tags = protowire.AppendVarint(tags, valueIndex(uint64(getMaxBucket(cell.GridCell))))
+		tags = protowire.AppendVarint(tags, 14)
+		tags = protowire.AppendVarint(tags, valueIndex(uint64(cell.AntennaCount)))
+
+		// Clockwise ring in tile coordinates: NW, NE, SE, SW
+		var geometry []byte
+		geometry = protowire.AppendVarint(geometry, mvtCommand(mvtCmdMoveTo, 1))
+		geometry = protowire.AppendVarint(geometry, protowire.EncodeZigZag(x0))
+		geometry = protowire.AppendVarint(geometry, protowire.EncodeZigZag(y0))
+		geometry = protowire.AppendVarint(geometry, mvtCommand(mvtCmdLineTo, 3))
+		geometry = protowire.AppendVarint(geometry, protowire.EncodeZigZag(x1-x0))
+		geometry = protowire.AppendVarint(geometry, protowire.EncodeZigZag(0))
+		geometry = protowire.AppendVarint(geometry, protowire.EncodeZigZag(0))
+		geometry = protowire.AppendVarint(geometry, protowire.EncodeZigZag(y1-y0))
+		geometry = protowire.AppendVarint(geometry, protowire.EncodeZigZag(x0-x1))
+		geometry = protowire.AppendVarint(geometry, protowire.EncodeZigZag(0))
+		geometry = protowire.AppendVarint(geometry, mvtCommand(mvtCmdClosePath, 1))
+
+		var feature []byte
+		feature = protowire.AppendTag(feature, 1, protowire.VarintType) // id
+		feature = protowire.AppendVarint(feature, uint64(cell.X)<<19|uint64(cell.Y))
+		feature = protowire.AppendTag(feature, 2, protowire.BytesType) // tags
+		feature = protowire.AppendBytes(feature, tags)
+		feature = protowire.AppendTag(feature, 3, protowire.VarintType) // type
+		feature = protowire.AppendVarint(feature, mvtGeomPolygon)
+		feature = protowire.AppendTag(feature, 4, protowire.BytesType) // geometry
+		feature = protowire.AppendBytes(feature, geometry)
+
+		layer = protowire.AppendTag(layer, 2, protowire.BytesType) // features
+		layer = protowire.AppendBytes(layer, feature)
+	}
+
+	for _, key := range mvtKeys {
+		layer = protowire.AppendTag(layer, 3, protowire.BytesType) // keys
+		layer = protowire.AppendString(layer, key)
+	}
+	for _, value := range values {
+		var encodedValue []byte
+		encodedValue = protowire.AppendTag(encodedValue, 5, protowire.VarintType) // uint_value
+		encodedValue = protowire.AppendVarint(encodedValue, value)
+
+		layer = protowire.AppendTag(layer, 4, protowire.BytesType) // values
+		layer = protowire.AppendBytes(layer, encodedValue)
+	}
+	layer = protowire.AppendTag(layer, 5, protowire.VarintType) // extent
+	layer = protowire.AppendVarint(layer, mvtExtent)
+
+	var tile []byte
+	tile = protowire.AppendTag(tile, 3, protowire.BytesType) // layers
+	tile = protowire.AppendBytes(tile, layer)
+	return tile
+}
+
+func mvtCommand(id uint64, count uint64) uint64 {
+	return (id & 0x7) | (count << 3)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Decode the features of the single layer in a vector tile to their id and attributes
+func decodeMvtFeatures(t *testing.T, tile []byte) map[uint64]map[string]uint64 {
+	var layer []byte
+	for len(tile) > 0 {
+		num, typ, n := protowire.ConsumeTag(tile)
+		tile = tile[n:]
+		if num == 3 {
+			v, n := protowire.ConsumeBytes(tile)
+			layer = v
+			tile = tile[n:]
+			continue
+		}
+		tile = tile[protowire.ConsumeFieldValue(num, typ, tile):]
+	}
+
+	var keys []string
+	var values []uint64
+	var features [][]byte
+	for len(layer) > 0 {
+		num, typ, n := protowire.ConsumeTag(layer)
+		if n < 0 {
+			t.Fatal("invalid layer")
+		}
+		layer = layer[n:]
+		if typ != protowire.BytesType {
+			layer = layer[protowire.ConsumeFieldValue(num, typ, layer):]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(layer)
+		layer = layer[n:]
+		switch num {
+		case 2:
+			features = append(features, v)
+		case 3:
+			keys = append(keys, string(v))
+		case 4:
+			_, _, n := protowire.ConsumeTag(v)
+			value, _ := protowire.ConsumeVarint(v[n:])
+			values = append(values, value)
+		}
+	}
+
+	decoded := map[uint64]map[string]uint64{}
+	for _, feature := range features {
+		var id uint64
+		attributes := map[string]uint64{}
+		for len(feature) > 0 {
+			num, typ, n := protowire.ConsumeTag(feature)
+			feature = feature[n:]
+			switch {
+			case num == 1:
+				id, n = protowire.ConsumeVarint(feature)
+				feature = feature[n:]
+			case num == 2:
+				tags, n := protowire.ConsumeBytes(feature)
+				feature = feature[n:]
+				for len(tags) > 0 {
+					key, n := protowire.ConsumeVarint(tags)
+					tags = tags[n:]
+					value, n := protowire.ConsumeVarint(tags)
+					tags = tags[n:]
+					attributes[keys[key]] = values[value]
+				}
+			default:
+				feature = feature[protowire.ConsumeFieldValue(num, typ, feature):]
+			}
+		}
+		decoded[id] = attributes
+	}
+
+	return decoded
+}
+
+func TestGetMvtTile(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/mvt/network/thethingsnetwork.org/14/9050/9835.pbf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Type") != "application/vnd.mapbox-vector-tile" {
+		t.Errorf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+
+	tile, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	features := decodeMvtFeatures(t, tile)
+	if len(features) != 2 {
+		t.Fatalf("expected 2 features, got %d", len(features))
+	}
+
+	// Both antennas of the gateway are merged into one feature
+	cell := features[289610<<19|314730]
+	expected := map[string]uint64{"bucket_high": 5, "bucket_100": 1, "bucket_110": 3, "bucket_low": 0, "max_bucket": 0, "antenna_count": 2}
+	for key, value := range expected {
+		if cell[key] != value {
+			t.Errorf("%s: expected %d, got %d", key, value, cell[key])
+		}
+	}
+	if features[289620<<19|314740]["max_bucket"] != 2 {
+		t.Errorf("expected max bucket 2, got %d", features[289620<<19|314740]["max_bucket"])
+	}
+}
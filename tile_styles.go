@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// BucketStyle is how a cell is drawn when its MaxBucketIndex is a certain bucket
+type BucketStyle struct {
+	R     float64
+	G     float64
+	B     float64
+	Alpha float64
+
+	// Circle radius as a multiple of the nominal radius for the zoom level
+	RadiusFactor float64
+}
+
+// TileStyle maps each of the 13 buckets to a colour, alpha and radius factor
+type TileStyle struct {
+	Name    string
+	Buckets [13]BucketStyle
+}
+
+// Named palettes that can be selected with ?style= or the DefaultStyle configuration
+var tileStyles = map[string]TileStyle{
+	// Red for the strongest signal through blue for the weakest, black for no signal
+	"classic": {
+		Name: "classic",
+		Buckets: [13]BucketStyle{
+			{1, 0, 0, 1, 1.0},
+			{1, 0.5, 0, 1, 1.1},
+			{1, 1, 0, 1, 1.2},
+			{0, 1, 0, 1, 1.3},
+			{0, 1, 1, 1, 1.4},
+			{0, 0, 1, 1, 1.5},
+			{0, 0, 1, 1, 1.5},
+			{0, 0, 1, 1, 1.5},
+			{0, 0, 1, 1, 1.5},
+			{0, 0, 1, 1, 1.5},
+			{0, 0, 1, 1, 1.5},
+			{0, 0, 1, 1, 1.5},
+			{0, 0, 0, 1, 1.6},
+		},
+	},
+	// Viridis, which stays distinguishable for the common forms of colour blindness
+	"colorblind": {
+		Name: "colorblind",
+		Buckets: [13]BucketStyle{
+			{0.992, 0.906, 0.145, 1, 1.0},
+			{0.627, 0.855, 0.224, 1, 1.1},
+			{0.290, 0.757, 0.427, 1, 1.2},
+			{0.122, 0.631, 0.529, 1, 1.3},
+			{0.153, 0.498, 0.557, 1, 1.4},
+			{0.212, 0.361, 0.553, 1, 1.5},
+			{0.212, 0.361, 0.553, 1, 1.5},
+			{0.212, 0.361, 0.553, 1, 1.5},
+			{0.212, 0.361, 0.553, 1, 1.5},
+			{0.212, 0.361, 0.553, 1, 1.5},
+			{0.212, 0.361, 0.553, 1, 1.5},
+			{0.212, 0.361, 0.553, 1, 1.5},
+			{0.267, 0.004, 0.329, 1, 1.6},
+		},
+	},
+	// Dark for the strongest signal, light for the weakest, translucent for no signal
+	"grayscale": {
+		Name: "grayscale",
+		Buckets: [13]BucketStyle{
+			{0.1, 0.1, 0.1, 1, 1.0},
+			{0.25, 0.25, 0.25, 1, 1.1},
+			{0.4, 0.4, 0.4, 1, 1.2},
+			{0.55, 0.55, 0.55, 1, 1.3},
+			{0.7, 0.7, 0.7, 1, 1.4},
+			{0.85, 0.85, 0.85, 1, 1.5},
+			{0.85, 0.85, 0.85, 1, 1.5},
+			{0.85, 0.85, 0.85, 1, 1.5},
+			{0.85, 0.85, 0.85, 1, 1.5},
+			{0.85, 0.85, 0.85, 1, 1.5},
+			{0.85, 0.85, 0.85, 1, 1.5},
+			{0.85, 0.85, 0.85, 1, 1.5},
+			{0, 0, 0, 0.4, 1.6},
+		},
+	},
+}
+
+// Return the style selected by the style query parameter, or the configured default style
+func GetRequestTileStyle(r *http.Request) (TileStyle, error) {
+	name := r.URL.Query().Get("style")
+	if name == "" {
+		name = myConfiguration.DefaultStyle
+	}
+
+	style, ok := tileStyles[name]
+	if !ok {
+		return style, errors.New("style invalid")
+	}
+	return style, nil
+}
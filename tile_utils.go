@@ -1,12 +1,237 @@
 package main
 
 import (
+	"errors"
+	"github.com/gorilla/mux"
 	"math"
+	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 	"ttnmapper-tms/types"
 )
 
+// TileRequest holds the path variables shared by all tile endpoints
+type TileRequest struct {
+	NetworkId     string
+	GatewayId     string
+	SingleGateway bool
+
+	// Further networks combined with NetworkId into one network tile
+	Networks []string
+
+	// Empty for the grid_cells, or one of the TileSource constants to aggregate the packets matching PacketFilter
+	Source       string
+	PacketFilter PacketFilter
+	Experiment   string
+	AppId        string
+	DevId        string
+	User         string
+
+	Z int
+	X int
+	Y int
+
+	// 1 for normal 256px tiles, 2 for 512px high-DPI tiles requested as {y}@2x.png
+	Scale int
+
+	// How grid cells are reduced to the bucket they are drawn with
+	Aggregation CellAggregation
+
+	// Only draw grid cells last updated in this window
+	Window TimeWindow
+
+	// Also draw the coverage of gateways that are offline on network tiles
+	IncludeOffline bool
+
+	// Only count the grid cells updated after the gateway was installed at its current location. Gateway tiles
+	// apply this by narrowing their Window, network tiles per antenna.
+	SinceInstall bool
+}
+
+// Parse the tile path variables of a request. The y index may carry the given file extension and a @2x suffix.
+func parseTilePath(r *http.Request, extension string) (TileRequest, error) {
+	vars := mux.Vars(r)
+	tileRequest := TileRequest{}
+
+	tileRequest.NetworkId = vars["network_id"]
+	tileRequest.GatewayId, tileRequest.SingleGateway = vars["gateway_id"]
+	tileRequest.Source = vars["source"]
+	tileRequest.Experiment = vars["experiment"]
+	tileRequest.AppId = vars["app_id"]
+	tileRequest.DevId = vars["dev_id"]
+	tileRequest.User = vars["user"]
+
+	// We've chosen to use mux.NewRouter().UseEncodedPath() which will return the path variables in encoded form.
+	// This is necessary to correctly pass NS_TTS:// (two forward slashes).
+	// Decode now.
+	tileRequest.NetworkId, _ = url.QueryUnescape(tileRequest.NetworkId)
+	tileRequest.GatewayId, _ = url.QueryUnescape(tileRequest.GatewayId)
+	tileRequest.Experiment, _ = url.QueryUnescape(tileRequest.Experiment)
+	tileRequest.AppId, _ = url.QueryUnescape(tileRequest.AppId)
+	tileRequest.DevId, _ = url.QueryUnescape(tileRequest.DevId)
+	tileRequest.User, _ = url.QueryUnescape(tileRequest.User)
+
+	var err error
+	tileRequest.Z, err = strconv.Atoi(vars["z"])
+	if err != nil {
+		return tileRequest, errors.New("z invalid")
+	}
+
+	tileRequest.X, err = strconv.Atoi(vars["x"])
+	if err != nil {
+		return tileRequest, errors.New("x invalid")
+	}
+
+	yVar := strings.TrimSuffix(vars["y"], extension)
+	tileRequest.Scale = 1
+	if strings.HasSuffix(yVar, "@2x") {
+		yVar = strings.TrimSuffix(yVar, "@2x")
+		tileRequest.Scale = 2
+	}
+
+	tileRequest.Y, err = strconv.Atoi(yVar)
+	if err != nil {
+		return tileRequest, errors.New("y invalid")
+	}
+
+	return tileRequest, nil
+}
+
+// Parse a tile request from the path variables and the query parameters shared by the tile endpoints
+func parseTileRequest(r *http.Request, extension string) (TileRequest, error) {
+	tileRequest, err := parseTilePath(r, extension)
+	if err != nil {
+		return tileRequest, err
+	}
+	err = parseTileOptions(r, &tileRequest)
+	return tileRequest, err
+}
+
+// Parse the aggregation, since, until, include_offline, networks and since_install query parameters, and the
+// packet filter of packet-backed tiles
+func parseTileOptions(r *http.Request, tileRequest *TileRequest) error {
+	var err error
+	tileRequest.Aggregation, err = GetRequestAggregation(r)
+	if err != nil {
+		return err
+	}
+
+	tileRequest.Window, err = GetRequestTimeWindow(r)
+	if err != nil {
+		return err
+	}
+
+	tileRequest.IncludeOffline, err = GetRequestIncludeOffline(r)
+	if err != nil {
+		return err
+	}
+
+	tileRequest.Networks, err = GetRequestNetworks(r, *tileRequest)
+	if err != nil {
+		return err
+	}
+
+	// Gateway tiles leave out the grid cells from before the gateway moved by default
+	tileRequest.SinceInstall, err = GetRequestSinceInstall(r, tileRequest.SingleGateway)
+	if err != nil {
+		return err
+	}
+
+	if tileRequest.Source != "" {
+		tileRequest.PacketFilter, err = GetRequestPacketFilter(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Return whether the include_offline query parameter asks for the coverage of offline gateways
+func GetRequestIncludeOffline(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("include_offline")
+	if value == "" {
+		return false, nil
+	}
+
+	includeOffline, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("include_offline invalid")
+	}
+	return includeOffline, nil
+}
+
+// Return whether the since_install query parameter asks to skip the grid cells from before a gateway moved,
+// or the default if it is not given
+func GetRequestSinceInstall(r *http.Request, defaultValue bool) (bool, error) {
+	value := r.URL.Query().Get("since_install")
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	sinceInstall, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("since_install invalid")
+	}
+	return sinceInstall, nil
+}
+
+// Return the further networks listed in the networks query parameter, sorted and without NetworkId.
+// Only network tiles can combine networks.
+func GetRequestNetworks(r *http.Request, tileRequest TileRequest) ([]string, error) {
+	var networks []string
+	for _, networkId := range splitQueryList(r.URL.Query().Get("networks")) {
+		if networkId != tileRequest.NetworkId && !slices.Contains(networks, networkId) {
+			networks = append(networks, networkId)
+		}
+	}
+
+	if len(networks) > 0 && (tileRequest.SingleGateway || tileRequest.PacketsOnly()) {
+		return nil, errors.New("networks only allowed on network tiles")
+	}
+
+	slices.Sort(networks)
+	return networks, nil
+}
+
+// Return all networks a network tile is drawn from
+func (t TileRequest) GetNetworkIds() []string {
+	return append([]string{t.NetworkId}, t.Networks...)
+}
+
+// Return the antennas network tiles are drawn from
+func (t TileRequest) AntennaSelection() AntennaSelection {
+	return AntennaSelection{IncludeOffline: t.IncludeOffline, SinceInstall: t.SinceInstall}
+}
+
+// Return the filter selecting the packets of a packet-backed tile
+func (t TileRequest) GetPacketFilter() PacketFilter {
+	filter := t.PacketFilter
+	filter.NetworkId = t.NetworkId
+	filter.GatewayId = t.GatewayId
+	filter.Experiment = t.Experiment
+	filter.AppId = t.AppId
+	filter.DevId = t.DevId
+	filter.User = t.User
+	return filter
+}
+
+// Experiment, device and user tiles are only drawn from packets. They are not part of the coverage map and
+// its grid_cells, so the cache invalidator does not see when they change.
+func (t TileRequest) PacketsOnly() bool {
+	return t.Source == TileSourceExperiment || t.Source == TileSourceDevice || t.Source == TileSourceUser
+}
+
+// Only network tiles are cached on demand. Per gateway tiles are only cached when seeded, and tiles drawn only
+// from packets are never cached. Neither are tiles combining networks, as the cache is invalidated per network.
+func (t TileRequest) CacheOnDemand() bool {
+	return !t.SingleGateway && !t.PacketsOnly() && len(t.Networks) == 0
+}
+
 func GetCacheDurationForZoom(z int) time.Duration {
 	//if z >= 18 {
 	//	return 0 * time.Second // always redraw
@@ -71,6 +296,117 @@ func GetZ19TileRangeBuffer(xOuter int, yOuter int, z int, buffer float64) (xMin
 	return int(xNw), int(yNw), int(xSe), int(ySe)
 }
 
+// Return the bucket counts of a grid cell, indexed like MaxBucketIndex
+func gridCellBuckets(gridCell types.GridCell) [13]uint {
+	return [13]uint{
+		gridCell.BucketHigh, gridCell.Bucket100, gridCell.Bucket105, gridCell.Bucket110, gridCell.Bucket115,
+		gridCell.Bucket120, gridCell.Bucket125, gridCell.Bucket130, gridCell.Bucket135, gridCell.Bucket140,
+		gridCell.Bucket145, gridCell.BucketLow, gridCell.BucketNoSignal,
+	}
+}
+
+// The bucket counts of a grid cell by index, to update them in place
+func gridCellBucketPointers(gridCell *types.GridCell) [13]*uint {
+	return [13]*uint{
+		&gridCell.BucketHigh, &gridCell.Bucket100, &gridCell.Bucket105, &gridCell.Bucket110, &gridCell.Bucket115,
+		&gridCell.Bucket120, &gridCell.Bucket125, &gridCell.Bucket130, &gridCell.Bucket135, &gridCell.Bucket140,
+		&gridCell.Bucket145, &gridCell.BucketLow, &gridCell.BucketNoSignal,
+	}
+}
+
+// BoundingBox is a WGS84 area given as min longitude, min latitude, max longitude, max latitude
+type BoundingBox struct {
+	MinLon float64
+	MinLat float64
+	MaxLon float64
+	MaxLat float64
+}
+
+// Parse a bbox query parameter in the form minLon,minLat,maxLon,maxLat
+func ParseBoundingBox(bbox string) (BoundingBox, error) {
+	parts := strings.Split(bbox, ",")
+	if len(parts) != 4 {
+		return BoundingBox{}, errors.New("bbox should be minLon,minLat,maxLon,maxLat")
+	}
+
+	var values [4]float64
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return BoundingBox{}, errors.New("bbox invalid")
+		}
+		values[i] = value
+	}
+
+	boundingBox := BoundingBox{MinLon: values[0], MinLat: values[1], MaxLon: values[2], MaxLat: values[3]}
+	if boundingBox.MinLon < -180 || boundingBox.MaxLon > 180 || boundingBox.MinLat < -90 || boundingBox.MaxLat > 90 ||
+		boundingBox.MinLon > boundingBox.MaxLon || boundingBox.MinLat > boundingBox.MaxLat {
+		return BoundingBox{}, errors.New("bbox out of range")
+	}
+
+	return boundingBox, nil
+}
+
+// Return the bounding box of tile x,y at zoom z, extended by buffer tiles on every side
+func TileBoundingBox(x int, y int, z int, buffer float64) BoundingBox {
+	return BoundingBox{
+		MinLon: TileXToLon(float64(x)-buffer, z),
+		MinLat: TileYToLat(float64(y)+1+buffer, z),
+		MaxLon: TileXToLon(float64(x)+1+buffer, z),
+		MaxLat: TileYToLat(float64(y)-buffer, z),
+	}
+}
+
+// Return the tile index range covering the bounding box at zoom z. The max indexes are inclusive.
+func (b BoundingBox) TileRange(z int) (xMin int, yMin int, xMax int, yMax int) {
+	// Web mercator does not reach the poles
+	maxLat := math.Min(b.MaxLat, 85.0511)
+	minLat := math.Max(b.MinLat, -85.0511)
+
+	xMin = int(math.Floor(LonToTileX(b.MinLon, z)))
+	xMax = int(math.Floor(LonToTileX(b.MaxLon, z)))
+	yMin = int(math.Floor(LatToTileY(maxLat, z)))
+	yMax = int(math.Floor(LatToTileY(minLat, z)))
+
+	// The east and south edges of the world are the last tile, not the next one
+	xMax = min(xMax, 1<<z-1)
+	yMax = min(yMax, 1<<z-1)
+	return xMin, yMin, xMax, yMax
+}
+
+// Return the range of z19 tiles covering the bounding box. The max indexes are inclusive.
+func (b BoundingBox) Z19Range() (xMin int, yMin int, xMax int, yMax int) {
+	return b.TileRange(19)
+}
+
+// Names of the buckets in types.GridCell, indexed like MaxBucketIndex
+var bucketNames = [13]string{
+	"bucket_high", "bucket_100", "bucket_105", "bucket_110", "bucket_115", "bucket_120", "bucket_125",
+	"bucket_130", "bucket_135", "bucket_140", "bucket_145", "bucket_low", "bucket_no_signal",
+}
+
+// Fractional web mercator tile x index of a longitude at zoom z
+func LonToTileX(lon float64, z int) float64 {
+	return (lon + 180.0) / 360.0 * math.Exp2(float64(z))
+}
+
+// Fractional web mercator tile y index of a latitude at zoom z
+func LatToTileY(lat float64, z int) float64 {
+	latRad := lat * math.Pi / 180.0
+	return (1.0 - math.Log(math.Tan(latRad)+1.0/math.Cos(latRad))/math.Pi) / 2.0 * math.Exp2(float64(z))
+}
+
+// Longitude of the west edge of tile x at zoom z
+func TileXToLon(x float64, z int) float64 {
+	return x/math.Exp2(float64(z))*360.0 - 180.0
+}
+
+// Latitude of the north edge of tile y at zoom z
+func TileYToLat(y float64, z int) float64 {
+	n := math.Pi - 2.0*math.Pi*y/math.Exp2(float64(z))
+	return 180.0 / math.Pi * math.Atan(math.Sinh(n))
+}
+
 func getMaxBucket(gridCell types.GridCell) int {
 	maxBucketIndex := 12 // Use NoSignal as default
 	maxBucketCount := gridCell.BucketNoSignal
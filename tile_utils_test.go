@@ -9,3 +9,20 @@ func TestGetZ19TileRangeBuffer(t *testing.T) {
 	xNw, yNw, xSe, ySe := GetZ19TileRangeBuffer(100, 100, 17, 0.5)
 	log.Println(xNw, yNw, xSe, ySe)
 }
+
+func TestBoundingBoxZ19Range(t *testing.T) {
+	boundingBox, err := ParseBoundingBox(testTileBbox())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xMin, yMin, xMax, yMax := boundingBox.Z19Range()
+	if xMin != testTileX*32 || yMin != testTileY*32 || xMax != testTileX*32+31 || yMax != testTileY*32+31 {
+		t.Errorf("unexpected range %d,%d %d,%d", xMin, yMin, xMax, yMax)
+	}
+
+	_, err = ParseBoundingBox("10,20,5,30")
+	if err == nil {
+		t.Error("expected error for min longitude larger than max longitude")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Format of the since and until times in cache file names
+const timeWindowNameFormat = "20060102T150405Z"
+
+// TimeWindow restricts the grid cells a tile is drawn from to those last updated in it.
+// Since is inclusive and Until exclusive. A zero time leaves that side of the window open.
+type TimeWindow struct {
+	Since time.Time
+	Until time.Time
+}
+
+// Return the window selected by the since and until query parameters, given as RFC 3339 times or dates
+func GetRequestTimeWindow(r *http.Request) (TimeWindow, error) {
+	query := r.URL.Query()
+	window := TimeWindow{}
+
+	var err error
+	if query.Has("since") {
+		window.Since, err = parseWindowTime(query.Get("since"))
+		if err != nil {
+			return window, errors.New("since invalid")
+		}
+	}
+	if query.Has("until") {
+		window.Until, err = parseWindowTime(query.Get("until"))
+		if err != nil {
+			return window, errors.New("until invalid")
+		}
+	}
+
+	if !window.Since.IsZero() && !window.Until.IsZero() && !window.Until.After(window.Since) {
+		return window, errors.New("until should be after since")
+	}
+
+	return window, nil
+}
+
+func parseWindowTime(value string) (time.Time, error) {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		parsed, err = time.Parse(time.DateOnly, value)
+	}
+	return parsed.UTC(), err
+}
+
+// Check if a time falls in the window
+func (w TimeWindow) Contains(t time.Time) bool {
+	if !w.Since.IsZero() && t.Before(w.Since) {
+		return false
+	}
+	if !w.Until.IsZero() && !t.Before(w.Until) {
+		return false
+	}
+	return true
+}
+
+// Name used to tell tiles with different windows apart in the disk cache. Empty for an open window.
+func (w TimeWindow) Name() string {
+	name := ""
+	if !w.Since.IsZero() {
+		name += "since" + w.Since.Format(timeWindowNameFormat)
+	}
+	if !w.Until.IsZero() {
+		if name != "" {
+			name += "-"
+		}
+		name += "until" + w.Until.Format(timeWindowNameFormat)
+	}
+	return name
+}
+
+// Apply the since_install option of a tile request. Gateway tiles narrow their window to start when the gateway was
+// installed at its current location, network tiles leave out grid cells per antenna. Returns the value of the
+// X-Since-Install header telling clients about it: the installation time on gateway tiles, per-gateway on network
+// tiles, or empty if no grid cells are left out.
+func ApplySinceInstall(store SampleStore, tileRequest *TileRequest) (string, error) {
+	// Experiments, devices and users are measured at one time, wherever the gateways were then
+	if tileRequest.PacketsOnly() {
+		tileRequest.SinceInstall = false
+	}
+	if !tileRequest.SinceInstall {
+		return "", nil
+	}
+	if !tileRequest.SingleGateway {
+		return "per-gateway", nil
+	}
+
+	installedAt, err := store.GetGatewayInstalledAt(tileRequest.NetworkId, tileRequest.GatewayId)
+	if err != nil || installedAt.IsZero() {
+		return "", err
+	}
+
+	installedAt = installedAt.UTC()
+	if installedAt.After(tileRequest.Window.Since) {
+		tileRequest.Window.Since = installedAt
+	}
+	return installedAt.Format(time.RFC3339), nil
+}
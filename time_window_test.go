@@ -0,0 +1,90 @@
+package main
+
+import (
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestGetTileTimeWindow(t *testing.T) {
+	cacheEnabled, cacheDirBlocks := myConfiguration.CacheEnabled, myConfiguration.CacheDirBlocks
+	defer func() { myConfiguration.CacheEnabled, myConfiguration.CacheDirBlocks = cacheEnabled, cacheDirBlocks }()
+	myConfiguration.CacheEnabled = true
+	myConfiguration.CacheDirBlocks = t.TempDir()
+
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	// Cell 289610,314730 was last updated before the window, cell 289620,314740 in it
+	tile := getTestResponse(t, server, "/blocks/network/thethingsnetwork.org/14/9050/9835.png?since=2021-05-03", png.Decode)
+	assertPixel(t, tile, 80, 80, color.RGBA{})
+	assertPixel(t, tile, 160, 160, color.RGBA{R: 255, G: 255, A: 255})
+
+	tile = getTestResponse(t, server, "/blocks/network/thethingsnetwork.org/14/9050/9835.png?until=2021-05-03T00:00:00Z", png.Decode)
+	assertPixel(t, tile, 80, 80, color.RGBA{R: 255, A: 255})
+	assertPixel(t, tile, 160, 160, color.RGBA{})
+
+	// Every window is cached separately
+	for _, fileName := range []string{"classic-since20210503T000000Z.png", "classic-until20210503T000000Z.png"} {
+		_, err := os.Stat(myConfiguration.CacheDirBlocks + "/network/thethingsnetwork.org/14/9050/9835/" + fileName)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, query := range []string{"?since=yesterday", "?until=2021-13-01", "?since=2021-05-03&until=2021-05-01"} {
+		resp, err := http.Get(server.URL + "/circles/network/thethingsnetwork.org/14/9050/9835.png" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", query, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
+
+func TestGetTileSinceInstall(t *testing.T) {
+	cacheEnabled := myConfiguration.CacheEnabled
+	defer func() { myConfiguration.CacheEnabled = cacheEnabled }()
+	myConfiguration.CacheEnabled = false
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	// The gateway moved on 2021-05-02, after cell 289610,314730 of its first antenna was last updated.
+	// Gateway tiles leave that cell out by default, so only the weaker second antenna is left.
+	for _, test := range []struct {
+		path     string
+		header   string
+		expected color.RGBA
+	}{
+		{"/blocks/gateway/thethingsnetwork.org/eui-60c5a8fffe761551/14/9050/9835.png", "2021-05-02T00:00:00Z", color.RGBA{G: 255, A: 255}},
+		{"/blocks/gateway/thethingsnetwork.org/eui-60c5a8fffe761551/14/9050/9835.png?since_install=false", "", color.RGBA{R: 255, A: 255}},
+		{"/blocks/network/thethingsnetwork.org/14/9050/9835.png?since_install=true", "per-gateway", color.RGBA{G: 255, A: 255}},
+		{"/blocks/network/thethingsnetwork.org/14/9050/9835.png", "", color.RGBA{R: 255, A: 255}},
+	} {
+		resp, err := http.Get(server.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if header := resp.Header.Get("X-Since-Install"); header != test.header {
+			t.Errorf("%s: expected X-Since-Install %q, got %q", test.path, test.header, header)
+		}
+
+		tile := getTestResponse(t, server, test.path, png.Decode)
+		assertPixel(t, tile, 80, 80, test.expected)
+	}
+
+	resp, err := http.Get(server.URL + "/blocks/network/thethingsnetwork.org/14/9050/9835.png?since_install=maybe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
@@ -0,0 +1,19 @@
+package types
+
+// GeoJSON objects as defined in RFC 7946
+
+type GeoJsonFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJsonFeature `json:"features"`
+}
+
+type GeoJsonFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoJsonGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GeoJsonGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
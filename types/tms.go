@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 type Sample struct {
 	X              int
 	Y              int
@@ -12,3 +14,41 @@ type ByRssi []Sample
 func (a ByRssi) Len() int           { return len(a) }
 func (a ByRssi) Less(i, j int) bool { return a[i].MaxBucketIndex > a[j].MaxBucketIndex }
 func (a ByRssi) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// MergedGridCell is the sum of the grid cells of all antennas at one z19 x,y
+type MergedGridCell struct {
+	GridCell
+	AntennaCount int
+}
+
+// GridCellUpdate is a z19 cell of a gateway that received new measurements
+type GridCellUpdate struct {
+	NetworkId   string
+	GatewayId   string
+	X           int
+	Y           int
+	LastUpdated time.Time
+}
+
+// AntennaStatus holds what decides whether the coverage of an antenna is shown on network tiles
+type AntennaStatus struct {
+	AntennaID uint
+	// When the gateway owning the antenna was last heard
+	LastHeard time.Time
+	// The gateway is blacklisted by forcing its location to 0,0
+	Blacklisted bool
+	// When the gateway was installed at its current location, zero if unknown
+	InstalledAt time.Time
+}
+
+// NetworkSummary is a network with the number of gateways it has
+type NetworkSummary struct {
+	NetworkId    string
+	GatewayCount int
+}
+
+// GatewaySummary is a gateway with the number of antennas it has
+type GatewaySummary struct {
+	Gateway
+	AntennaCount int
+}
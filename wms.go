@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"ttnmapper-tms/types"
+)
+
+// Limits of a WMS GetMap request. Maps that would need more tiles are drawn from tiles at a lower zoom.
+const (
+	wmsMaxSize   = 2048
+	wmsMaxTiles  = 256
+	wmsMaxLayers = 4
+)
+
+// Radius of the sphere of the web mercator projection
+const mercatorRadius = 6378137.0
+
+// Coordinate reference systems WMS maps can be requested in. EPSG:4326 has its axes in latitude, longitude order.
+var wmsCrs = []string{"EPSG:3857", "EPSG:4326", "CRS:84"}
+
+// Parameters of the WMS standard. Any others are options of the tiles, like since or include_offline.
+var wmsParameters = []string{"SERVICE", "REQUEST", "VERSION", "LAYERS", "STYLES", "CRS", "BBOX", "WIDTH", "HEIGHT",
+	"FORMAT", "TRANSPARENT", "BGCOLOR", "EXCEPTIONS", "TIME", "ELEVATION"}
+
+// wmsError is a WMS service exception with its code, like InvalidCRS
+type wmsError struct {
+	Code    string
+	Message string
+}
+
+func (e wmsError) Error() string {
+	return e.Message
+}
+
+// wmsLayer is one of the layers of a GetMap request. Layers are named after the tile type and the network, like
+// circles/thethingsnetwork.org.
+type wmsLayer struct {
+	Blocks bool
+	Style  TileStyle
+	TileRequest
+}
+
+// WmsMapRequest is a parsed GetMap request
+type WmsMapRequest struct {
+	Layers []wmsLayer
+	Crs    string
+	// The bounding box in the x,y order of the CRS: longitude, latitude for EPSG:4326
+	MinX, MinY, MaxX, MaxY float64
+	Width, Height          int
+	Transparent            bool
+	Background             color.RGBA
+}
+
+// GetWms serves the circles and blocks coverage of the networks through WMS 1.3.0, for GIS software that does not
+// read XYZ tiles. The maps are stitched together from tiles, so that they are drawn exactly like the tiles.
+// Besides the WMS parameters, GetMap takes the gateway_id, aggregation, since, until, include_offline, networks
+// and since_install options of the tiles.
+func (s *TileServer) GetWms(w http.ResponseWriter, r *http.Request) {
+	params := wmsRequestParameters(r)
+
+	if service := params.Get("SERVICE"); service != "" && service != "WMS" {
+		writeWmsException(w, wmsError{"InvalidParameterValue", "service invalid"})
+		return
+	}
+
+	switch params.Get("REQUEST") {
+	case "GetCapabilities":
+		s.GetWmsCapabilities(w, r)
+	case "GetMap":
+		s.GetWmsMap(w, r, params)
+	default:
+		writeWmsException(w, wmsError{"OperationNotSupported", "request invalid"})
+	}
+}
+
+// GetWmsCapabilities lists a circles and a blocks layer for each network
+func (s *TileServer) GetWmsCapabilities(w http.ResponseWriter, r *http.Request) {
+	// Page through the networks so that every network gets its layers
+	var networks []types.NetworkSummary
+	for {
+		page, err := s.store.GetNetworks(ListQuery{Offset: len(networks), Limit: listMaxLimit})
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		networks = append(networks, page...)
+		if len(page) < listMaxLimit {
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	_, err := fmt.Fprint(w, xml.Header)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	err = encoder.Encode(CreateWmsCapabilities(wmsServiceUrl(r), networks))
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// GetWmsMap draws the requested layers on top of each other
+func (s *TileServer) GetWmsMap(w http.ResponseWriter, r *http.Request, params url.Values) {
+	mapRequest, err := ParseWmsMapRequest(r, params)
+	if err != nil {
+		writeWmsException(w, err)
+		return
+	}
+
+	log.Printf("WMS map %s: %f,%f %f,%f %dx%d\t", mapRequest.Crs, mapRequest.MinX, mapRequest.MinY, mapRequest.MaxX, mapRequest.MaxY, mapRequest.Width, mapRequest.Height)
+
+	img, err := s.RenderWmsMap(r.Context(), mapRequest)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	imgBytes, err := EncodeTile(img)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "encoding error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	_, err = w.Write(imgBytes)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// WMS parameter names are case insensitive, the tile options are not
+func wmsRequestParameters(r *http.Request) url.Values {
+	params := url.Values{}
+	for key, values := range r.URL.Query() {
+		if slices.Contains(wmsParameters, strings.ToUpper(key)) {
+			params[strings.ToUpper(key)] = values
+		}
+	}
+	return params
+}
+
+// Parse a GetMap request. Errors are wmsErrors.
+func ParseWmsMapRequest(r *http.Request, params url.Values) (WmsMapRequest, error) {
+	mapRequest := WmsMapRequest{Crs: params.Get("CRS")}
+
+	if version := params.Get("VERSION"); version != "" && version != "1.3.0" {
+		return mapRequest, wmsError{"InvalidParameterValue", "version invalid, only 1.3.0 is supported"}
+	}
+	if format := params.Get("FORMAT"); format != "image/png" {
+		return mapRequest, wmsError{"InvalidFormat", "format invalid, only image/png is supported"}
+	}
+	if !slices.Contains(wmsCrs, mapRequest.Crs) {
+		return mapRequest, wmsError{"InvalidCRS", "crs invalid"}
+	}
+
+	bbox := strings.Split(params.Get("BBOX"), ",")
+	if len(bbox) != 4 {
+		return mapRequest, wmsError{"InvalidParameterValue", "bbox invalid"}
+	}
+	var coordinates [4]float64
+	for i, value := range bbox {
+		var err error
+		coordinates[i], err = strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(coordinates[i]) || math.IsInf(coordinates[i], 0) {
+			return mapRequest, wmsError{"InvalidParameterValue", "bbox invalid"}
+		}
+	}
+	mapRequest.MinX, mapRequest.MinY, mapRequest.MaxX, mapRequest.MaxY = coordinates[0], coordinates[1], coordinates[2], coordinates[3]
+	if mapRequest.Crs == "EPSG:4326" {
+		mapRequest.MinX, mapRequest.MinY, mapRequest.MaxX, mapRequest.MaxY = coordinates[1], coordinates[0], coordinates[3], coordinates[2]
+	}
+	if mapRequest.MinX >= mapRequest.MaxX || mapRequest.MinY >= mapRequest.MaxY {
+		return mapRequest, wmsError{"InvalidParameterValue", "bbox invalid"}
+	}
+
+	var err error
+	mapRequest.Width, err = strconv.Atoi(params.Get("WIDTH"))
+	if err != nil || mapRequest.Width < 1 || mapRequest.Width > wmsMaxSize {
+		return mapRequest, wmsError{"InvalidParameterValue", fmt.Sprintf("width invalid, the maximum is %d", wmsMaxSize)}
+	}
+	mapRequest.Height, err = strconv.Atoi(params.Get("HEIGHT"))
+	if err != nil || mapRequest.Height < 1 || mapRequest.Height > wmsMaxSize {
+		return mapRequest, wmsError{"InvalidParameterValue", fmt.Sprintf("height invalid, the maximum is %d", wmsMaxSize)}
+	}
+
+	switch strings.ToUpper(params.Get("TRANSPARENT")) {
+	case "", "FALSE":
+	case "TRUE":
+		mapRequest.Transparent = true
+	default:
+		return mapRequest, wmsError{"InvalidParameterValue", "transparent invalid"}
+	}
+	mapRequest.Background = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	if bgColor := params.Get("BGCOLOR"); bgColor != "" {
+		rgb, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(bgColor), "0x"), 16, 32)
+		if err != nil || len(bgColor) != 8 {
+			return mapRequest, wmsError{"InvalidParameterValue", "bgcolor invalid"}
+		}
+		mapRequest.Background = color.RGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 255}
+	}
+
+	mapRequest.Layers, err = parseWmsLayers(r, params)
+	return mapRequest, err
+}
+
+// Parse the layers and their styles, with the tile options that apply to all of them
+func parseWmsLayers(r *http.Request, params url.Values) ([]wmsLayer, error) {
+	if params.Get("LAYERS") == "" {
+		return nil, wmsError{"LayerNotDefined", "layers required"}
+	}
+	names := strings.Split(params.Get("LAYERS"), ",")
+	if len(names) > wmsMaxLayers {
+		return nil, wmsError{"InvalidParameterValue", fmt.Sprintf("layers invalid, the maximum is %d", wmsMaxLayers)}
+	}
+
+	styles := make([]string, len(names))
+	if params.Get("STYLES") != "" {
+		styles = strings.Split(params.Get("STYLES"), ",")
+		if len(styles) != len(names) {
+			return nil, wmsError{"StyleNotDefined", "styles must list a style for every layer"}
+		}
+	}
+
+	query := r.URL.Query()
+	tileRequest := TileRequest{Scale: 1}
+	tileRequest.GatewayId, tileRequest.SingleGateway = query.Get("gateway_id"), query.Get("gateway_id") != ""
+
+	err := parseTileOptions(r, &tileRequest)
+	if err != nil {
+		return nil, wmsError{"InvalidParameterValue", err.Error()}
+	}
+
+	var layers []wmsLayer
+	for i, name := range names {
+		layer := wmsLayer{TileRequest: tileRequest}
+
+		kind, networkId, found := strings.Cut(name, "/")
+		if !found || networkId == "" || (kind != "circles" && kind != "blocks") {
+			return nil, wmsError{"LayerNotDefined", "layer " + name + " invalid"}
+		}
+		layer.Blocks = kind == "blocks"
+		layer.NetworkId = networkId
+		layer.Networks = slices.DeleteFunc(slices.Clone(tileRequest.Networks), func(network string) bool {
+			return network == networkId
+		})
+
+		styleName := styles[i]
+		if styleName == "" || styleName == "default" {
+			styleName = myConfiguration.DefaultStyle
+		}
+		var ok bool
+		layer.Style, ok = tileStyles[styleName]
+		if !ok {
+			return nil, wmsError{"StyleNotDefined", "style " + styles[i] + " invalid"}
+		}
+
+		layers = append(layers, layer)
+	}
+	return layers, nil
+}
+
+// Draw a map from the tiles of each layer. The tiles are at the zoom at which they are at least as detailed as the
+// map, and are projected onto the map pixel by pixel.
+func (s *TileServer) RenderWmsMap(ctx context.Context, mapRequest WmsMapRequest) (image.Image, error) {
+	img := image.NewRGBA(image.Rect(0, 0, mapRequest.Width, mapRequest.Height))
+	if !mapRequest.Transparent {
+		draw.Draw(img, img.Bounds(), image.NewUniform(mapRequest.Background), image.Point{}, draw.Src)
+	}
+
+	minLon, _ := mapRequest.toLonLat(mapRequest.MinX, 0)
+	maxLon, _ := mapRequest.toLonLat(mapRequest.MaxX, 0)
+	_, minLat := mapRequest.toLonLat(0, mapRequest.MinY)
+	_, maxLat := mapRequest.toLonLat(0, mapRequest.MaxY)
+	minLon, maxLon = math.Max(minLon, -180), math.Min(maxLon, 180)
+	minLat, maxLat = math.Max(minLat, -mercatorMaxLat), math.Min(maxLat, mercatorMaxLat)
+	if minLon >= maxLon || minLat >= maxLat {
+		return img, nil
+	}
+
+	// Longitude is linear in x in both projections
+	lonPerPixel := (maxLon - minLon) / float64(mapRequest.Width)
+	// Allow for rounding, so that a map of exactly one tile is drawn from that tile
+	z := int(math.Ceil(math.Log2(360/(256*lonPerPixel)) - 1e-6))
+	z = max(0, min(19, z))
+	var xMin, yMin, xMax, yMax int
+	for ; ; z-- {
+		xMin, yMin, xMax, yMax = BoundingBox{MinLon: minLon, MinLat: minLat, MaxLon: maxLon, MaxLat: maxLat}.TileRange(z)
+		if z == 0 || (xMax-xMin+1)*(yMax-yMin+1) <= wmsMaxTiles {
+			break
+		}
+	}
+
+	// The columns and rows of the map each tile column and row is drawn in, with the pixel of the tile they show
+	type tilePixel struct {
+		Map  int
+		Tile int
+	}
+	columns := make([][]tilePixel, xMax-xMin+1)
+	for px := 0; px < mapRequest.Width; px++ {
+		lon, _ := mapRequest.toLonLat(mapRequest.MinX+(float64(px)+0.5)/float64(mapRequest.Width)*(mapRequest.MaxX-mapRequest.MinX), 0)
+		if lon < -180 || lon >= 180 {
+			continue
+		}
+		column := int(math.Floor((LonToTileX(lon, z) - float64(xMin)) * 256))
+		if column >= 0 && column/256 < len(columns) {
+			columns[column/256] = append(columns[column/256], tilePixel{Map: px, Tile: column % 256})
+		}
+	}
+	rows := make([][]tilePixel, yMax-yMin+1)
+	for py := 0; py < mapRequest.Height; py++ {
+		_, lat := mapRequest.toLonLat(0, mapRequest.MaxY-(float64(py)+0.5)/float64(mapRequest.Height)*(mapRequest.MaxY-mapRequest.MinY))
+		if lat <= -mercatorMaxLat || lat >= mercatorMaxLat {
+			continue
+		}
+		row := int(math.Floor((LatToTileY(lat, z) - float64(yMin)) * 256))
+		if row >= 0 && row/256 < len(rows) {
+			rows[row/256] = append(rows[row/256], tilePixel{Map: py, Tile: row % 256})
+		}
+	}
+
+	// Every tile is drawn onto the map directly, in premultiplied colours
+	tilePixels := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for _, layer := range mapRequest.Layers {
+		tileRequest := layer.TileRequest
+		_, err := ApplySinceInstall(s.store, &tileRequest)
+		if err != nil {
+			return nil, err
+		}
+
+		tileRequest.Z = z
+		for i, tileColumns := range columns {
+			for j, tileRows := range rows {
+				if len(tileColumns) == 0 || len(tileRows) == 0 {
+					continue
+				}
+
+				tileRequest.X, tileRequest.Y = xMin+i, yMin+j
+				tile, err := s.getWmsTile(ctx, layer, tileRequest)
+				if err != nil {
+					return nil, err
+				}
+				draw.Draw(tilePixels, tilePixels.Bounds(), tile, tile.Bounds().Min, draw.Src)
+
+				for _, row := range tileRows {
+					for _, column := range tileColumns {
+						blendPixel(img, column.Map, row.Map, tilePixels.RGBAAt(column.Tile, row.Tile))
+					}
+				}
+			}
+		}
+	}
+
+	return img, nil
+}
+
+// Return a tile of a layer the way the tile endpoints serve it: from the disk cache if it is there, otherwise
+// rendered once for all concurrent requests of the tile
+func (s *TileServer) getWmsTile(ctx context.Context, layer wmsLayer, tileRequest TileRequest) (image.Image, error) {
+	tileFileName := GetCirclesTileFileName(tileRequest, layer.Style)
+	if layer.Blocks {
+		tileFileName = GetBlocksTileFileName(tileRequest, layer.Style)
+	}
+
+	if myConfiguration.CacheEnabled {
+		if _, ok := TileInCache(tileFileName, tileRequest.Z); ok {
+			tile, err := LoadTileFromFile(tileFileName)
+			if err == nil {
+				return tile, nil
+			}
+			log.Println(err.Error())
+		}
+	}
+
+	tileBytes, err := s.renderCoalescer.Do(tileFileName, func() ([]byte, error) {
+		ctx, cancel := renderContext(ctx)
+		defer cancel()
+
+		// The version is stored with the tile for the tile endpoints that serve it from the cache later
+		storeTile := myConfiguration.CacheEnabled && tileRequest.CacheOnDemand()
+		var version TileVersion
+		var err error
+		if storeTile {
+			xMin, yMin, xMax, yMax := getLayerTileRange(tileRequest, layer.Blocks)
+			version, err = GetTileVersion(ctx, s.store, tileRequest, xMin, yMin, xMax, yMax)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var tile image.Image
+		if layer.Blocks {
+			tile, err = s.RenderBlocksTile(ctx, tileRequest, layer.Style)
+		} else {
+			tile, err = s.RenderCirclesTile(ctx, tileRequest, layer.Style)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if storeTile {
+			StoreTileInFile(tile, tileFileName, version)
+		}
+
+		return EncodeTile(tile)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(tileBytes))
+}
+
+// Draw a premultiplied colour over a pixel
+func blendPixel(img *image.RGBA, x int, y int, src color.RGBA) {
+	if src.A == 0 {
+		return
+	}
+	if src.A == 255 {
+		img.SetRGBA(x, y, src)
+		return
+	}
+	dst := img.RGBAAt(x, y)
+	remaining := uint32(255 - src.A)
+	img.SetRGBA(x, y, color.RGBA{
+		R: src.R + uint8(uint32(dst.R)*remaining/255),
+		G: src.G + uint8(uint32(dst.G)*remaining/255),
+		B: src.B + uint8(uint32(dst.B)*remaining/255),
+		A: src.A + uint8(uint32(dst.A)*remaining/255),
+	})
+}
+
+// Convert map coordinates to a longitude and latitude
+func (m WmsMapRequest) toLonLat(x float64, y float64) (float64, float64) {
+	if m.Crs == "EPSG:3857" {
+		return x / mercatorRadius * 180 / math.Pi, (2*math.Atan(math.Exp(y/mercatorRadius)) - math.Pi/2) * 180 / math.Pi
+	}
+	return x, y
+}
+
+// Write a WMS service exception report
+func writeWmsException(w http.ResponseWriter, err error) {
+	var serviceError wmsError
+	if !errors.As(err, &serviceError) {
+		serviceError = wmsError{"InvalidParameterValue", err.Error()}
+	}
+
+	report := struct {
+		XMLName   xml.Name `xml:"http://www.opengis.net/ogc ServiceExceptionReport"`
+		Version   string   `xml:"version,attr"`
+		Exception struct {
+			Code    string `xml:"code,attr"`
+			Message string `xml:",chardata"`
+		} `xml:"ServiceException"`
+	}{Version: "1.3.0"}
+	report.Exception.Code = serviceError.Code
+	report.Exception.Message = serviceError.Message
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(http.StatusBadRequest)
+	_, err = fmt.Fprint(w, xml.Header)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	err = xml.NewEncoder(w).Encode(report)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// The URL clients send their WMS requests to, keeping the tile options they requested the capabilities with.
+// It is built from the configured public URL, as the Host and X-Forwarded-Proto headers are set by the client.
+func wmsServiceUrl(r *http.Request) string {
+	options := url.Values{}
+	for key, values := range r.URL.Query() {
+		if !slices.Contains(wmsParameters, strings.ToUpper(key)) {
+			options[key] = values
+		}
+	}
+
+	serviceUrl := strings.TrimSuffix(myConfiguration.PublicUrl, "/") + r.URL.Path + "?"
+	if len(options) > 0 {
+		serviceUrl += options.Encode() + "&"
+	}
+	return serviceUrl
+}
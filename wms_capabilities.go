@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/xml"
+	"slices"
+	"strconv"
+	"ttnmapper-tms/types"
+)
+
+// Extent of the web mercator projection in metres
+const mercatorMaxXY = 20037508.342789244
+
+type wmsCapabilities struct {
+	XMLName    xml.Name      `xml:"WMS_Capabilities"`
+	Version    string        `xml:"version,attr"`
+	Xmlns      string        `xml:"xmlns,attr"`
+	XmlnsXlink string        `xml:"xmlns:xlink,attr"`
+	Service    wmsService    `xml:"Service"`
+	Capability wmsCapability `xml:"Capability"`
+}
+
+type wmsService struct {
+	Name           string            `xml:"Name"`
+	Title          string            `xml:"Title"`
+	Abstract       string            `xml:"Abstract"`
+	OnlineResource wmsOnlineResource `xml:"OnlineResource"`
+}
+
+type wmsOnlineResource struct {
+	Type string `xml:"xlink:type,attr"`
+	Href string `xml:"xlink:href,attr"`
+}
+
+type wmsCapability struct {
+	GetCapabilities wmsOperation `xml:"Request>GetCapabilities"`
+	GetMap          wmsOperation `xml:"Request>GetMap"`
+	Exception       []string     `xml:"Exception>Format"`
+	Layer           wmsLayerInfo `xml:"Layer"`
+}
+
+type wmsOperation struct {
+	Format         []string          `xml:"Format"`
+	OnlineResource wmsOnlineResource `xml:"DCPType>HTTP>Get>OnlineResource"`
+}
+
+type wmsLayerInfo struct {
+	Queryable   string            `xml:"queryable,attr,omitempty"`
+	Name        string            `xml:"Name,omitempty"`
+	Title       string            `xml:"Title"`
+	Crs         []string          `xml:"CRS"`
+	Geographic  *wmsGeographicBox `xml:"EX_GeographicBoundingBox"`
+	BoundingBox []wmsBoundingBox  `xml:"BoundingBox"`
+	Styles      []wmsStyle        `xml:"Style"`
+	Layers      []wmsLayerInfo    `xml:"Layer"`
+}
+
+type wmsGeographicBox struct {
+	West  float64 `xml:"westBoundLongitude"`
+	East  float64 `xml:"eastBoundLongitude"`
+	South float64 `xml:"southBoundLatitude"`
+	North float64 `xml:"northBoundLatitude"`
+}
+
+// The corners are formatted without exponent, which not every client reads
+type wmsBoundingBox struct {
+	Crs  string `xml:"CRS,attr"`
+	MinX string `xml:"minx,attr"`
+	MinY string `xml:"miny,attr"`
+	MaxX string `xml:"maxx,attr"`
+	MaxY string `xml:"maxy,attr"`
+}
+
+type wmsStyle struct {
+	Name  string `xml:"Name"`
+	Title string `xml:"Title"`
+}
+
+// Create the capabilities document, with a circles and a blocks layer for each network. The layers share the
+// projections and extent of the web mercator tiles they are drawn from.
+func CreateWmsCapabilities(onlineResource string, networks []types.NetworkSummary) wmsCapabilities {
+	resource := wmsOnlineResource{Type: "simple", Href: onlineResource}
+
+	// The default style is listed first
+	var styles []wmsStyle
+	styleNames := []string{myConfiguration.DefaultStyle}
+	for name := range tileStyles {
+		if name != myConfiguration.DefaultStyle {
+			styleNames = append(styleNames, name)
+		}
+	}
+	slices.Sort(styleNames[1:])
+	for _, name := range styleNames {
+		styles = append(styles, wmsStyle{Name: name, Title: name})
+	}
+
+	root := wmsLayerInfo{
+		Title: "TTN Mapper coverage",
+		Crs:   wmsCrs,
+		Geographic: &wmsGeographicBox{
+			West: -180, East: 180, South: -mercatorMaxLat, North: mercatorMaxLat,
+		},
+		BoundingBox: []wmsBoundingBox{
+			newWmsBoundingBox("EPSG:3857", -mercatorMaxXY, -mercatorMaxXY, mercatorMaxXY, mercatorMaxXY),
+			newWmsBoundingBox("EPSG:4326", -mercatorMaxLat, -180, mercatorMaxLat, 180),
+			newWmsBoundingBox("CRS:84", -180, -mercatorMaxLat, 180, mercatorMaxLat),
+		},
+	}
+	for _, network := range networks {
+		for _, kind := range []string{"circles", "blocks"} {
+			root.Layers = append(root.Layers, wmsLayerInfo{
+				Queryable: "0",
+				Name:      kind + "/" + network.NetworkId,
+				Title:     "Coverage of " + network.NetworkId + " drawn as " + kind,
+				Styles:    styles,
+			})
+		}
+	}
+
+	return wmsCapabilities{
+		Version:    "1.3.0",
+		Xmlns:      "http://www.opengis.net/wms",
+		XmlnsXlink: "http://www.w3.org/1999/xlink",
+		Service: wmsService{
+			Name:           "WMS",
+			Title:          "TTN Mapper",
+			Abstract:       "Coverage of LoRaWAN gateways measured by TTN Mapper contributors",
+			OnlineResource: resource,
+		},
+		Capability: wmsCapability{
+			GetCapabilities: wmsOperation{Format: []string{"text/xml"}, OnlineResource: resource},
+			GetMap:          wmsOperation{Format: []string{"image/png"}, OnlineResource: resource},
+			Exception:       []string{"XML"},
+			Layer:           root,
+		},
+	}
+}
+
+func newWmsBoundingBox(crs string, minX float64, minY float64, maxX float64, maxY float64) wmsBoundingBox {
+	format := func(value float64) string {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return wmsBoundingBox{Crs: crs, MinX: format(minX), MinY: format(minY), MaxX: format(maxX), MaxY: format(maxY)}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Web mercator coordinates of a longitude and latitude
+func testMercator(lon float64, lat float64) (float64, float64) {
+	return lon * math.Pi / 180 * mercatorRadius, math.Log(math.Tan(math.Pi/4+lat*math.Pi/360)) * mercatorRadius
+}
+
+func TestGetWmsMap(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	// The bounds of tile 14/9050/9835
+	west, east := TileXToLon(9050, 14), TileXToLon(9051, 14)
+	north, south := TileYToLat(9835, 14), TileYToLat(9836, 14)
+	minX, minY := testMercator(west, south)
+	maxX, maxY := testMercator(east, north)
+
+	layers := url.QueryEscape("blocks/" + testNetworkId)
+	for _, test := range []struct {
+		crs  string
+		bbox string
+	}{
+		{"EPSG:3857", fmt.Sprintf("%f,%f,%f,%f", minX, minY, maxX, maxY)},
+		{"EPSG:4326", fmt.Sprintf("%f,%f,%f,%f", south, west, north, east)},
+		{"CRS:84", fmt.Sprintf("%f,%f,%f,%f", west, south, east, north)},
+	} {
+		// Drawn like the blocks tile, where cell 289610,314730 covers pixels 80 to 88
+		path := "/wms?SERVICE=WMS&VERSION=1.3.0&REQUEST=GetMap&FORMAT=image/png&STYLES=&WIDTH=256&HEIGHT=256&LAYERS=" + layers +
+			"&CRS=" + test.crs + "&BBOX=" + test.bbox
+		img := getTestResponse(t, server, path+"&TRANSPARENT=TRUE", png.Decode)
+		assertPixel(t, img, 84, 84, color.RGBA{R: 255, A: 255})
+		assertPixel(t, img, 40, 40, color.RGBA{})
+
+		// Maps are opaque by default
+		img = getTestResponse(t, server, path, png.Decode)
+		assertPixel(t, img, 40, 40, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+		img = getTestResponse(t, server, path+"&BGCOLOR=0x0000FF", png.Decode)
+		assertPixel(t, img, 40, 40, color.RGBA{B: 255, A: 255})
+	}
+
+	// Tile options apply to all layers
+	path := "/wms?REQUEST=GetMap&FORMAT=image/png&WIDTH=256&HEIGHT=256&TRANSPARENT=TRUE&LAYERS=" + layers +
+		"&CRS=CRS:84&BBOX=" + fmt.Sprintf("%f,%f,%f,%f", west, south, east, north)
+	img := getTestResponse(t, server, path+"&until=2021-04-01", png.Decode)
+	assertPixel(t, img, 84, 84, color.RGBA{})
+
+	for _, test := range []struct {
+		query string
+		code  string
+	}{
+		{"REQUEST=GetFeatureInfo", "OperationNotSupported"},
+		{"REQUEST=GetMap&FORMAT=image/png&CRS=EPSG:2154&BBOX=0,0,1,1&WIDTH=256&HEIGHT=256&LAYERS=" + layers, "InvalidCRS"},
+		{"REQUEST=GetMap&FORMAT=image/jpeg&CRS=CRS:84&BBOX=0,0,1,1&WIDTH=256&HEIGHT=256&LAYERS=" + layers, "InvalidFormat"},
+		{"REQUEST=GetMap&FORMAT=image/png&CRS=CRS:84&BBOX=0,0,1,1&WIDTH=256&HEIGHT=256&LAYERS=lines/thethingsnetwork.org", "LayerNotDefined"},
+		{"REQUEST=GetMap&FORMAT=image/png&CRS=CRS:84&BBOX=0,0,1,1&WIDTH=256&HEIGHT=256&STYLES=neon&LAYERS=" + layers, "StyleNotDefined"},
+		{"REQUEST=GetMap&FORMAT=image/png&CRS=CRS:84&BBOX=1,1,0,0&WIDTH=256&HEIGHT=256&LAYERS=" + layers, "InvalidParameterValue"},
+		{"REQUEST=GetMap&FORMAT=image/png&CRS=CRS:84&BBOX=0,0,1,1&WIDTH=4096&HEIGHT=256&LAYERS=" + layers, "InvalidParameterValue"},
+		{"REQUEST=GetMap&FORMAT=image/png&CRS=CRS:84&BBOX=0,0,1,1&WIDTH=256&HEIGHT=256&LAYERS=" + strings.Repeat(layers+",", wmsMaxLayers) + layers, "InvalidParameterValue"},
+	} {
+		resp, err := http.Get(server.URL + "/wms?" + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusBadRequest || !bytes.Contains(body, []byte(`code="`+test.code+`"`)) {
+			t.Errorf("%s: expected exception %s, got %d %s", test.query, test.code, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestGetWmsMapCached(t *testing.T) {
+	cacheEnabled, cacheDirBlocks := myConfiguration.CacheEnabled, myConfiguration.CacheDirBlocks
+	defer func() { myConfiguration.CacheEnabled, myConfiguration.CacheDirBlocks = cacheEnabled, cacheDirBlocks }()
+	myConfiguration.CacheEnabled = true
+	myConfiguration.CacheDirBlocks = t.TempDir()
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	// Maps are drawn from the same cached tiles as the tile endpoints serve
+	west, east := TileXToLon(9050, 14), TileXToLon(9051, 14)
+	north, south := TileYToLat(9835, 14), TileYToLat(9836, 14)
+	path := "/wms?REQUEST=GetMap&FORMAT=image/png&WIDTH=256&HEIGHT=256&TRANSPARENT=TRUE&LAYERS=" + url.QueryEscape("blocks/"+testNetworkId) +
+		"&CRS=CRS:84&BBOX=" + fmt.Sprintf("%f,%f,%f,%f", west, south, east, north)
+	getTestResponse(t, server, path, png.Decode)
+	tileFileName := myConfiguration.CacheDirBlocks + "/network/thethingsnetwork.org/14/9050/9835/classic.png"
+	_, err := os.Stat(tileFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A cached tile is not rendered again
+	err = os.WriteFile(tileFileName, testBlankTile(t), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := getTestResponse(t, server, path, png.Decode)
+	assertPixel(t, img, 84, 84, color.RGBA{})
+}
+
+// An empty tile encoded as png
+func testBlankTile(t *testing.T) []byte {
+	tileBytes, err := EncodeTile(image.NewRGBA(image.Rect(0, 0, 256, 256)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tileBytes
+}
+
+func TestGetWmsCapabilities(t *testing.T) {
+	server := httptest.NewServer(NewTileServer(newTestStore(t)).NewRouter())
+	defer server.Close()
+
+	publicUrl := myConfiguration.PublicUrl
+	defer func() { myConfiguration.PublicUrl = publicUrl }()
+	myConfiguration.PublicUrl = "https://tms.example.org/"
+
+	// The headers of the client are not used for the URL of the service
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/wms?service=WMS&request=GetCapabilities&since=2021-01-01", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "attacker.example.org"
+	req.Header.Set("X-Forwarded-Proto", "ftp")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	var capabilities struct {
+		Version        string `xml:"version,attr"`
+		OnlineResource struct {
+			Href string `xml:"href,attr"`
+		} `xml:"Service>OnlineResource"`
+		Layers []struct {
+			Name   string   `xml:"Name"`
+			Styles []string `xml:"Style>Name"`
+		} `xml:"Capability>Layer>Layer"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&capabilities)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if capabilities.Version != "1.3.0" {
+		t.Errorf("unexpected version %s", capabilities.Version)
+	}
+	// The tile options are kept in the URL of the service
+	if capabilities.OnlineResource.Href != "https://tms.example.org/wms?since=2021-01-01&" {
+		t.Errorf("unexpected online resource %s", capabilities.OnlineResource.Href)
+	}
+	if len(capabilities.Layers) != 4 || capabilities.Layers[0].Name != "circles/"+testV3NetworkId || capabilities.Layers[3].Name != "blocks/"+testNetworkId {
+		t.Errorf("unexpected layers %v", capabilities.Layers)
+	}
+	if len(capabilities.Layers) > 0 && (len(capabilities.Layers[0].Styles) != len(tileStyles) || capabilities.Layers[0].Styles[0] != "classic") {
+		t.Errorf("unexpected styles %v", capabilities.Layers[0].Styles)
+	}
+}